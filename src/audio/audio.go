@@ -0,0 +1,21 @@
+// Package audio tells songs from other files, the same way for ltt, which
+// writes them, and meh, which plays them.
+package audio
+
+import (
+	"path"
+	"strings"
+)
+
+// Exts are the extensions of the audio files ltt can download, write or
+// import.
+var Exts = map[string]bool{
+	".mp3": true, ".ogg": true, ".oga": true, ".opus": true,
+	".flac": true, ".m4a": true, ".aac": true, ".wav": true,
+}
+
+// IsFile returns whether name, a file name or a slash-separated path, has
+// the extension of an audio file.
+func IsFile(name string) bool {
+	return Exts[strings.ToLower(path.Ext(name))]
+}
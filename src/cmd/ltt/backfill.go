@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var backfillBucket = []byte("backfill")
+
+// Checkpoint records how far a backfill has walked through a listing, so
+// that an interrupted backfill can pick up where it left off.
+type Checkpoint struct {
+	// After is the listing cursor of the next page to fetch.
+	After string
+
+	// Since is the cutoff the backfill was started with. A checkpoint is
+	// only resumed by a backfill with the same cutoff.
+	Since time.Time
+
+	// Done is set once the backfill has reached the end of the listing or
+	// the cutoff.
+	Done bool
+
+	Updated time.Time
+}
+
+func checkpointKey(sub *Subscription, sort string) []byte {
+	return []byte(sub.Path + ":" + sort)
+}
+
+// Checkpoint returns the saved backfill checkpoint for sub and sort, or nil
+// if there is none.
+func (l *Library) Checkpoint(sub *Subscription, sort string) (*Checkpoint, error) {
+	var cp *Checkpoint
+	err := l.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(backfillBucket)
+		if b == nil {
+			return nil
+		}
+		data := b.Get(checkpointKey(sub, sort))
+		if data == nil {
+			return nil
+		}
+		cp = &Checkpoint{}
+		return json.Unmarshal(data, cp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// SaveCheckpoint saves the backfill checkpoint for sub and sort.
+func (l *Library) SaveCheckpoint(sub *Subscription, sort string, cp *Checkpoint) error {
+	cp.Updated = time.Now()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return l.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(backfillBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(checkpointKey(sub, sort), data)
+	})
+}
+
+func runBackfill(cfg *Config, args []string) error {
+	fs := newFlagSet("backfill")
+	feedName := fs.String("feed", "", "backfill only this subscription, by name or subreddit path")
+	sort := fs.String("sort", "new", "listing to walk: new or top")
+	sinceFlag := fs.String("since", "", "skip posts submitted before this date (YYYY-MM-DD)")
+	restart := fs.Bool("restart", false, "ignore saved checkpoints and start from the newest post")
+	delay := fs.Duration("delay", 2*time.Second, "pause between listing pages")
+	fs.Parse(args)
+
+	if *sort != "new" && *sort != "top" {
+		return fmt.Errorf("unsupported sort %q", *sort)
+	}
+	var since time.Time
+	if *sinceFlag != "" {
+		var err error
+		since, err = time.ParseInLocation("2006-01-02", *sinceFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %v", err)
+		}
+	}
+	subs := cfg.Feeds
+	if *feedName != "" {
+		sub := cfg.Subscription(*feedName)
+		if sub == nil {
+			return fmt.Errorf("no subscription named %q or with that path", *feedName)
+		}
+		subs = []*Subscription{sub}
+	}
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	p := newPoller(lib, cfg)
+	for _, sub := range subs {
+		err := p.backfill(sub, *sort, since, *restart, *delay)
+		if err != nil {
+			return fmt.Errorf("failed to backfill %q: %v", sub.DisplayName(), err)
+		}
+	}
+	return nil
+}
+
+// backfill walks the sort listing of sub back to since, archiving every
+// post p accepts that is not already in the history. The listing cursor is
+// checkpointed after each page.
+func (p *poller) backfill(sub *Subscription, sort string, since time.Time, restart bool, delay time.Duration) error {
+	cp, err := p.lib.Checkpoint(sub, sort)
+	if err != nil {
+		return err
+	}
+	if restart || cp == nil || !cp.Since.Equal(since) {
+		cp = &Checkpoint{Since: since}
+	} else if cp.Done {
+		log.Printf("backfill of %q already complete", sub.DisplayName())
+		return nil
+	} else if cp.After != "" {
+		log.Printf("resuming backfill of %q after %q", sub.DisplayName(), cp.After)
+	}
+
+	for {
+		listing, err := FetchListing(p.client, ListingURL(sub, sort, cp.After))
+		if err != nil {
+			return err
+		}
+
+		reachedSince := false
+		for _, post := range listing.Posts {
+			if post.Created().Before(since) {
+				// New listings are newest first, so everything after
+				// this is older still.
+				reachedSince = sort == "new"
+				continue
+			}
+			dl, err := ParsePost(post)
+			if err != nil {
+				log.Printf("don't know how to download %q: %v", post.Name, err)
+				continue
+			}
+			if p.accept(sub, dl) {
+				p.pool.Submit(dl)
+			}
+		}
+		summary := p.pool.Wait()
+		if !summary.Empty() {
+			log.Printf("%s", summary)
+		}
+		p.lib.retain()
+
+		cp.After = listing.After
+		cp.Done = reachedSince || listing.After == ""
+		err = p.lib.SaveCheckpoint(sub, sort, cp)
+		if err != nil {
+			return err
+		}
+		if cp.Done {
+			log.Printf("backfill of %q complete", sub.DisplayName())
+			return nil
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/SlyMarbo/rss"
+)
+
+func runFetch(cfg *Config, args []string) error {
+	fs := newFlagSet("fetch")
+	feedName := fs.String("feed", "", "fetch only this subscription, by name or subreddit path such as r/listentothis")
+	query := fs.String("query", "", "query string used when -feed is not a configured subscription, such as ?sort=top")
+	force := fs.Bool("force", false, "fetch feeds even if they have not changed since the last fetch")
+	concurrency := fs.Int("concurrency", 0, "maximum number of downloads at once (overrides config)")
+	explain := fs.Bool("explain", false, "print the rule that decides each post, without downloading anything")
+	dryRun := fs.Bool("dry-run", false, "print what would be downloaded, skipped or is already present, without downloading anything or touching the history")
+	fs.Parse(args)
+	if *explain && *dryRun {
+		return fmt.Errorf("-explain and -dry-run cannot be used together: the dry run already gives the rule that skipped each post")
+	}
+
+	subs := cfg.Feeds
+	if *feedName != "" {
+		sub := cfg.Subscription(*feedName)
+		if sub == nil {
+			sub = &Subscription{Path: *feedName, Query: *query}
+			err := sub.validate()
+			if err != nil {
+				return err
+			}
+		}
+		subs = []*Subscription{sub}
+	}
+
+	open := openLibrary
+	if *dryRun || *explain {
+		open = openReadOnlyLibrary
+	}
+	lib, err := open(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	p := newPoller(lib, cfg)
+	p.force = *force
+	p.explain = *explain
+	p.dryRun = *dryRun
+	if *concurrency > 0 {
+		p.pool = NewPool(lib, *concurrency, cfg.SiteConcurrency)
+	}
+	for _, r := range p.pollAll(subs) {
+		if r.err != nil {
+			log.Printf("failed to fetch %q: %v", r.sub.DisplayName(), r.err)
+		}
+	}
+	if p.dryRun {
+		return p.printPlan()
+	}
+	return nil
+}
+
+func runAdd(cfg *Config, args []string) error {
+	fs := newFlagSet("add")
+	title := fs.String("title", "", "title to record for the song")
+	folder := fs.String("folder", "", "directory, relative to the library, to save the song in")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := checkFolder(*folder)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	dl, err := NewDownload(rss.Item{
+		Title: *title,
+		Link:  u.String(),
+		Date:  time.Now(),
+	}, u)
+	if err != nil {
+		return fmt.Errorf("cannot download %q: %v", u, err)
+	}
+	// Songs added by hand have no post, so they are recorded by media.
+	dl.ID = dl.MediaID
+	dl.Folder = *folder
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	// The same checks as for posts in feeds, so that a song is not
+	// downloaded twice.
+	err = lib.Queue(dl)
+	switch {
+	case err == ErrAlreadyDownloaded || (err == ErrRepost && dl.Original == ""):
+		log.Printf("%q is already downloaded", dl.ID)
+		return nil
+	case err == ErrRepost:
+		log.Printf("%q is already downloaded, as %q", dl.ID, dl.Original)
+		return nil
+	case err == ErrNotDue || err == ErrDead:
+		return fmt.Errorf("%q failed before (%v); see ltt retry %s", dl.ID, err, dl.ID)
+	case err != nil:
+		return fmt.Errorf("failed to queue %q: %v", dl.ID, err)
+	}
+
+	err = lib.Archive(dl)
+	if err != nil {
+		return fmt.Errorf("failed to archive %q: %v", dl.ID, err)
+	}
+	log.Printf("downloaded %q", dl.ID)
+	return nil
+}
+
+func runConfig(cfg *Config, args []string) error {
+	fs := newFlagSet("config")
+	fs.Parse(args)
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", data)
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config holds the settings shared by all ltt subcommands. It is read from
+// a JSON file, by default $XDG_CONFIG_HOME/ltt/config.json.
+type Config struct {
+	// Library is the directory songs are downloaded into. The download
+	// history is kept in a .history database inside it.
+	Library string `json:"library"`
+
+	// Feeds are the subscriptions fetched by 'ltt fetch'.
+	Feeds []*Subscription `json:"feeds"`
+
+	// Rules decide which posts from all feeds are downloaded.
+	Rules Rules `json:"rules"`
+
+	// AudioFormat is the audio format requested from the downloader.
+	// "best" takes the audio as the site has it, leaving any encoding to
+	// the output profiles.
+	AudioFormat string `json:"audio_format"`
+
+	// Profiles are the output profiles that can be named in Outputs, in
+	// addition to the built-in "original", "vorbis", "opus", "mp3" and
+	// "flac", which they replace if they have the same name.
+	Profiles map[string]*Profile `json:"profiles"`
+
+	// Outputs name the profiles each download is made into.
+	Outputs []string `json:"outputs"`
+
+	// Naming is the template downloaded files are named with, relative to
+	// the library or the feed's folder. If it is empty, files keep the
+	// names the downloader gives them. See NameData for the fields.
+	Naming string `json:"naming"`
+
+	// CoverArt embeds the video thumbnail or album art in downloaded
+	// files, and saves it next to them.
+	CoverArt bool `json:"cover_art"`
+
+	// ReplayGain measures the loudness of downloaded files, and tags them
+	// with the gain that levels them.
+	ReplayGain bool `json:"replaygain"`
+
+	// Downloaders are tried in order until one succeeds: any of
+	// "youtube-dl", "yt-dlp" and "http".
+	Downloaders []string `json:"downloaders"`
+
+	// Concurrency is the maximum number of downloads at once.
+	Concurrency int `json:"concurrency"`
+
+	// SiteConcurrency limits the number of downloads at once from a
+	// site, named by resolver: "youtube", "bandcamp", "soundcloud",
+	// "vimeo" or "http".
+	SiteConcurrency map[string]int `json:"site_concurrency"`
+
+	// Retry decides when failed downloads are retried.
+	Retry RetryPolicy `json:"retry"`
+
+	// Interval is how often 'ltt daemon' polls each feed, unless the feed
+	// sets its own interval.
+	Interval Duration `json:"interval"`
+
+	// Retention limits the songs that have not been triaged, which are
+	// evicted after each run to keep within it.
+	Retention RetentionPolicy `json:"retention"`
+}
+
+// Duration is a time.Duration written in config files as a string, such as
+// "15m" or "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Library:         defaultPath(),
+		Feeds:           []*Subscription{{Path: "r/listentothis"}},
+		AudioFormat:     "best",
+		Profiles:        builtinProfiles(),
+		Outputs:         []string{"vorbis"},
+		CoverArt:        true,
+		ReplayGain:      true,
+		Downloaders:     []string{"youtube-dl", "yt-dlp", "http"},
+		Concurrency:     4,
+		SiteConcurrency: map[string]int{"youtube": 2},
+		Retry:           defaultRetryPolicy(),
+		Interval:        Duration{30 * time.Minute},
+	}
+}
+
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "ltt", "config.json")
+}
+
+// LoadConfig reads the config file at path. Settings missing from the file
+// keep their defaults, and a missing file is not an error.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %q: %v", path, err)
+	}
+	cfg.Library = expandHome(cfg.Library)
+	for _, name := range cfg.Downloaders {
+		_, err = NewDownloader(name, cfg.AudioFormat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid downloaders in config %q: %v", path, err)
+		}
+	}
+	if cfg.Naming != "" {
+		_, err = NewNamer(cfg.Naming)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config %q: %v", path, err)
+		}
+	}
+	_, err = cfg.outputProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("invalid outputs in config %q: %v", path, err)
+	}
+	err = cfg.Rules.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules in config %q: %v", path, err)
+	}
+	for _, sub := range cfg.Feeds {
+		err = sub.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid feed in config %q: %v", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// Subscription returns the configured subscription with the given name, or
+// else the first with the given path, such as "r/listentothis", or nil if
+// there is none.
+func (c *Config) Subscription(name string) *Subscription {
+	for _, sub := range c.Feeds {
+		if sub.DisplayName() == name {
+			return sub
+		}
+	}
+	// Reddit ignores the case of subreddit names.
+	for _, sub := range c.Feeds {
+		if strings.EqualFold(strings.Trim(sub.Path, "/"), strings.Trim(name, "/")) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// outputProfiles returns the profiles named by Outputs.
+func (c *Config) outputProfiles() ([]*Profile, error) {
+	profiles := builtinProfiles()
+	for name, p := range c.Profiles {
+		profiles[name] = p
+	}
+	var outputs []*Profile
+	for _, name := range c.Outputs {
+		p := profiles[name]
+		if p == nil {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		p.Name = name
+		err := p.validate()
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, p)
+	}
+	return outputs, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// coverSize is the width and height covers are scaled down to, which is
+// plenty for a player and keeps the tags small.
+const coverSize = 600
+
+// maxCoverBytes limits the images downloaded for covers.
+const maxCoverBytes = 10 << 20
+
+var coverClient = &http.Client{Timeout: time.Minute}
+
+// Picture is cover art to embed in a file.
+type Picture struct {
+	MIME          string
+	Width, Height int
+	Data          []byte
+}
+
+// fetchCover returns the cover art of dl: the video thumbnail, the
+// album art, or whatever image the media page offers.
+func fetchCover(dl *Download) (*Picture, error) {
+	var urls []string
+	switch {
+	case strings.HasPrefix(dl.MediaID, "youtube:"):
+		id := strings.TrimPrefix(dl.MediaID, "youtube:")
+		// Not every video has a high resolution thumbnail.
+		urls = []string{
+			"https://i.ytimg.com/vi/" + id + "/maxresdefault.jpg",
+			"https://i.ytimg.com/vi/" + id + "/hqdefault.jpg",
+		}
+	case dl.Backend == BackendMedia:
+		u, err := pageImage(dl.URL.String())
+		if err != nil {
+			return nil, err
+		}
+		urls = []string{u}
+	default:
+		return nil, nil
+	}
+
+	var err error
+	for _, u := range urls {
+		var img image.Image
+		img, err = fetchImage(u)
+		if err == nil {
+			return newPicture(img)
+		}
+	}
+	return nil, err
+}
+
+// pageImage returns the og:image of the page at u, which media sites set
+// to the thumbnail or the album art.
+func pageImage(u string) (string, error) {
+	resp, err := httpGet(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(resp.Body, maxCoverBytes))
+	if err != nil {
+		return "", err
+	}
+	img, ok := doc.Find("meta[property='og:image']").Attr("content")
+	if !ok || img == "" {
+		return "", fmt.Errorf("no image on %q", u)
+	}
+	return img, nil
+}
+
+func fetchImage(u string) (image.Image, error) {
+	resp, err := httpGet(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	img, _, err := image.Decode(io.LimitReader(resp.Body, maxCoverBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %v", u, err)
+	}
+	return img, nil
+}
+
+func httpGet(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := coverClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %q: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// newPicture crops img to a square, scales it down to at most coverSize,
+// and encodes it as a JPEG.
+func newPicture(img image.Image) (*Picture, error) {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	if side == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+	// Video thumbnails are letterboxed 16:9, so the middle is what
+	// matters.
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	size := side
+	if size > coverSize {
+		size = coverSize
+	}
+	square := scaleSquare(img, x0, y0, side, size)
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, square, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return nil, err
+	}
+	return &Picture{MIME: "image/jpeg", Width: size, Height: size, Data: buf.Bytes()}, nil
+}
+
+// scaleSquare scales the side by side square of img at x0, y0 to size by
+// size, averaging the pixels that fall in each output pixel.
+func scaleSquare(img image.Image, x0, y0, side, size int) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y*side/size, (y+1)*side/size
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x*side/size, (x+1)*side/size
+			if sx1 == sx0 {
+				sx1++
+			}
+			var r, g, b, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, _ := img.At(x0+sx, y0+sy).RGBA()
+					r, g, b, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), n+1
+				}
+			}
+			out.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), 0xffff})
+		}
+	}
+	return out
+}
+
+// encodeFLACPicture returns p as a FLAC PICTURE block, which Ogg files
+// also carry, base64 encoded, in a METADATA_BLOCK_PICTURE comment.
+func encodeFLACPicture(p *Picture) []byte {
+	var b bytes.Buffer
+	put := func(n int) {
+		binary.Write(&b, binary.BigEndian, uint32(n))
+	}
+	put(3) // Front cover.
+	put(len(p.MIME))
+	b.WriteString(p.MIME)
+	put(0) // No description.
+	put(p.Width)
+	put(p.Height)
+	put(24) // Bits per pixel.
+	put(0)  // Not indexed.
+	put(len(p.Data))
+	b.Write(p.Data)
+	return b.Bytes()
+}
+
+// saveCover writes p, the cover of dl, next to the song at path, as a JPEG
+// of the same name for players and meh to find, and returns the file.
+func (l *Library) saveCover(dl *Download, p *Picture, path string) (*File, error) {
+	dest := strings.TrimSuffix(path, filepath.Ext(path)) + ".jpg"
+	dest, err := l.freePath(dl, "", dest)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(dest, p.Data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return l.describeFile(dest)
+}
+
+// moveCover moves the cover of dl next to its first file, after the files
+// have been moved.
+func (l *Library) moveCover(dl *Download) error {
+	if dl.Cover == nil || len(dl.Files) == 0 {
+		return nil
+	}
+	want := strings.TrimSuffix(dl.Files[0].Path, filepath.Ext(dl.Files[0].Path)) + ".jpg"
+	if want == dl.Cover.Path {
+		return nil
+	}
+	from := l.absPath(dl.Cover)
+	to, err := l.freePath(dl, from, filepath.Join(l.Path, filepath.FromSlash(want)))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+	dl.Cover.Path, err = l.relPath(to)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// minInterval keeps a misconfigured feed from hammering reddit.
+const minInterval = time.Minute
+
+func runDaemon(cfg *Config, args []string) error {
+	fs := newFlagSet("daemon")
+	interval := fs.Duration("interval", cfg.Interval.Duration, "default polling interval for feeds that do not set one")
+	fs.Parse(args)
+
+	if len(cfg.Feeds) == 0 {
+		return fmt.Errorf("no feeds configured")
+	}
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	d := &daemon{
+		poller:   newPoller(lib, cfg),
+		interval: *interval,
+		next:     map[*Subscription]time.Time{},
+	}
+	d.setStop(stopOnSignal())
+	d.run(cfg.Feeds)
+	log.Printf("stopped")
+	return nil
+}
+
+type daemon struct {
+	*poller
+
+	interval time.Duration
+
+	// next is when each subscription is next due to be polled.
+	next map[*Subscription]time.Time
+}
+
+// run polls subs, each when it is due, until stopped.
+func (d *daemon) run(subs []*Subscription) {
+	for {
+		var sub *Subscription
+		for _, s := range subs {
+			if sub == nil || d.next[s].Before(d.next[sub]) {
+				sub = s
+			}
+		}
+
+		wait := d.next[sub].Sub(time.Now())
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-d.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if d.stopped() {
+			return
+		}
+		d.next[sub] = d.poll(sub)
+	}
+}
+
+// poll fetches sub, archives what it accepts, and returns when it should
+// next be polled.
+func (d *daemon) poll(sub *Subscription) time.Time {
+	interval := d.interval
+	if sub.Interval != nil && sub.Interval.Duration > 0 {
+		interval = sub.Interval.Duration
+	}
+	if interval < minInterval {
+		interval = minInterval
+	}
+	next := time.Now().Add(interval)
+
+	results := d.pollAll([]*Subscription{sub})
+	if len(results) == 0 {
+		// Stopped before the poll started.
+		return next
+	}
+	feed, err := results[0].feed, results[0].err
+	if terr, ok := err.(*ThrottledError); ok && terr.RetryAfter > interval {
+		next = time.Now().Add(terr.RetryAfter)
+	}
+	if err != nil {
+		log.Printf("failed to fetch %q: %v; next attempt at %s", sub.DisplayName(), err, next.Format(time.Kitchen))
+		return next
+	}
+
+	// The feed may ask not to be checked again until later.
+	if feed != nil && feed.Refresh.After(next) {
+		next = feed.Refresh
+	}
+	return next
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Downloader downloads media into a directory.
+type Downloader interface {
+	// Name identifies the downloader in the config and the history.
+	Name() string
+
+	// Supports returns whether the downloader can handle media needing
+	// the given backend.
+	Supports(backend string) bool
+
+	// Version returns the version of the downloader.
+	Version() (string, error)
+
+	// Download downloads dl into dir, and returns the paths of the files
+	// it wrote.
+	Download(dl *Download, dir string) ([]string, error)
+}
+
+// NewDownloader returns the downloader with the given name, extracting
+// audio in format where the downloader supports it.
+func NewDownloader(name, format string) (Downloader, error) {
+	switch name {
+	case "youtube-dl", "yt-dlp":
+		return &ytdlDownloader{command: name, format: format}, nil
+	case "http":
+		return &httpDownloader{client: &http.Client{Timeout: 30 * time.Minute}}, nil
+	}
+	return nil, fmt.Errorf("unknown downloader %q", name)
+}
+
+// ytdlDownloader runs youtube-dl, or yt-dlp which takes the same flags.
+type ytdlDownloader struct {
+	command string
+	format  string
+
+	versionOnce sync.Once
+	version     string
+	versionErr  error
+}
+
+func (d *ytdlDownloader) Name() string { return d.command }
+
+func (d *ytdlDownloader) Supports(backend string) bool {
+	return backend == BackendMedia || backend == BackendHTTP || backend == ""
+}
+
+func (d *ytdlDownloader) Version() (string, error) {
+	d.versionOnce.Do(func() {
+		out, err := childOutput(childCommand(d.command, "--version"))
+		d.version, d.versionErr = strings.TrimSpace(string(out)), err
+	})
+	return d.version, d.versionErr
+}
+
+// fileMarker prefixes the lines youtube-dl is asked to print with the path
+// of each file it writes.
+const fileMarker = "ltt-file:"
+
+func (d *ytdlDownloader) Download(dl *Download, dir string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := childCommand(d.command, "-x", "--audio-format", d.format,
+		"--exec", "echo "+fileMarker+" {}", dl.URL.String())
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := runChild(cmd)
+	if err != nil {
+		if msg := lastLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, fileMarker) {
+			continue
+		}
+		path := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, fileMarker)), `"'`)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s did not report the files it wrote", d.command)
+	}
+	return paths, nil
+}
+
+// lastLine returns the last non-blank line of s.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// httpDownloader downloads audio files directly.
+type httpDownloader struct {
+	client *http.Client
+}
+
+func (d *httpDownloader) Name() string { return "http" }
+
+func (d *httpDownloader) Supports(backend string) bool {
+	return backend == BackendHTTP
+}
+
+func (d *httpDownloader) Version() (string, error) {
+	return runtime.Version(), nil
+}
+
+func (d *httpDownloader) Download(dl *Download, dir string) ([]string, error) {
+	name := path.Base(dl.URL.Path)
+	if name == "/" || name == "." || strings.ContainsAny(name, `\:`) {
+		return nil, fmt.Errorf("no file name in %q", dl.URL.String())
+	}
+	dest := filepath.Join(dir, name)
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%q already exists", dest)
+	}
+
+	req, err := http.NewRequest("GET", dl.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %q: %s", dl.URL.String(), resp.Status)
+	}
+
+	// Download to a .part file like youtube-dl does, so that an
+	// interrupted download is not mistaken for a song.
+	part := dest + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(part)
+		return nil, err
+	}
+	err = os.Rename(part, dest)
+	if err != nil {
+		return nil, err
+	}
+	return []string{dest}, nil
+}
+
+// download downloads dl into dir with the first of the library's
+// downloaders that supports it and succeeds, makes the files for the
+// library's output profiles from what it wrote, finishes them, and records
+// the files, the cover, and which downloader wrote them.
+func (l *Library) download(dl *Download, dir string) error {
+	var errs []string
+	for _, d := range l.Downloaders {
+		if !d.Supports(dl.Backend) {
+			continue
+		}
+		paths, err := d.Download(dl, dir)
+		if err != nil {
+			log.Printf("%s failed to download %q: %v", d.Name(), dl.ID, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", d.Name(), err))
+			continue
+		}
+		outs, err := l.transcode(dl, paths)
+		if err != nil {
+			// transcode removes what it made, but not the downloads it
+			// failed to make them from.
+			removeFiles(paths)
+			log.Printf("failed to transcode what %s downloaded for %q: %v", d.Name(), dl.ID, err)
+			errs = append(errs, fmt.Sprintf("%s: failed to transcode: %v", d.Name(), err))
+			continue
+		}
+		tags := downloadTags(dl)
+		if l.CoverArt {
+			// Songs without covers are still worth keeping.
+			tags.Cover, err = fetchCover(dl)
+			if err != nil {
+				log.Printf("failed to fetch cover of %q: %v", dl.ID, err)
+			}
+		}
+		dl.Files = nil
+		dl.Cover = nil
+		for i, out := range outs {
+			var f *File
+			f, err = l.finishFile(dl, out, tags)
+			if err != nil {
+				err = fmt.Errorf("%s wrote %q, but: %v", d.Name(), out.path, err)
+				// Leave nothing of this attempt behind for the next
+				// downloader to trip over.
+				var left []string
+				for j := range dl.Files {
+					left = append(left, l.absPath(&dl.Files[j]))
+				}
+				for _, out := range outs[i:] {
+					left = append(left, out.path)
+				}
+				removeFiles(left)
+				dl.Files = nil
+				break
+			}
+			dl.Files = append(dl.Files, *f)
+		}
+		if err != nil {
+			log.Printf("failed to finish %q: %v", dl.ID, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		if tags.Cover != nil && len(dl.Files) > 0 {
+			dl.Cover, err = l.saveCover(dl, tags.Cover, l.absPath(&dl.Files[0]))
+			if err != nil {
+				log.Printf("failed to save cover of %q: %v", dl.ID, err)
+			}
+		}
+		dl.Downloader = d.Name()
+		dl.DownloaderVersion, err = d.Version()
+		if err != nil {
+			log.Printf("failed to get %s version: %v", d.Name(), err)
+		}
+		return nil
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no downloader supports %q", dl.URL.String())
+	}
+	return fmt.Errorf("all downloaders failed: %s", strings.Join(errs, "; "))
+}
+
+// removeFiles removes the files at paths, if they are there, logging
+// rather than failing, as it only cleans up after something that already
+// failed.
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove %q: %v", path, err)
+		}
+	}
+}
+
+// finishFile names the file made for an output after the library's naming
+// template, if any, measures its loudness, tags it, and describes it.
+func (l *Library) finishFile(dl *Download, out output, tags *Tags) (*File, error) {
+	path := out.path
+	if l.Namer != nil {
+		var err error
+		path, err = l.placeFile(dl, path, out.profile.folder())
+		if err != nil {
+			return nil, fmt.Errorf("failed to name it: %v", err)
+		}
+	}
+
+	// Songs that cannot be measured or tagged are still worth keeping.
+	var loudness *Loudness
+	if l.ReplayGain {
+		var err error
+		loudness, err = analyzeLoudness(path)
+		if err != nil {
+			log.Printf("failed to measure loudness of %q: %v", path, err)
+		} else {
+			tags = tags.clone()
+			loudness.addTags(tags, path)
+		}
+	}
+	err := writeTags(path, tags)
+	if err != nil && err != errUntaggable {
+		log.Printf("failed to tag %q: %v", path, err)
+	}
+
+	f, err := l.describeFile(path)
+	if err != nil {
+		// It may have been renamed, where the caller cannot find it.
+		os.Remove(path)
+		return nil, err
+	}
+	f.Loudness = loudness
+	if out.profile != nil {
+		f.Profile = out.profile.Name
+	}
+	return f, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exportFormats are the formats 'ltt export' writes.
+var exportFormats = map[string]func(w io.Writer, entries []*exportEntry) error{
+	"csv":   exportCSV,
+	"jsonl": exportJSONL,
+	"m3u8":  exportM3U,
+	"xspf":  exportXSPF,
+}
+
+// exportEntry is a download joined with its files that are still on disk.
+type exportEntry struct {
+	*Download
+
+	// present are the download's files found on disk, in the order they
+	// were recorded.
+	present []exportFile `json:"-"`
+
+	// Paths locate the present files, relative to the export for
+	// playlists, or absolute otherwise.
+	Paths []string
+
+	// cover locates the cover art on disk, as Paths does, if there is any.
+	cover string
+}
+
+type exportFile struct {
+	*File
+
+	// path locates the file, as Paths does.
+	path string
+}
+
+// duration returns the play time of the entry's first file in seconds,
+// rounded, or -1 if it is unknown.
+func (e *exportEntry) duration() int {
+	if len(e.present) == 0 || e.present[0].Duration <= 0 {
+		return -1
+	}
+	return int(math.Round(e.present[0].Duration))
+}
+
+func runExport(cfg *Config, args []string) error {
+	fs := newFlagSet("export")
+	qf := addQueryFlags(fs)
+	format := fs.String("format", "csv", "output format: csv, jsonl, m3u8 or xspf")
+	output := fs.String("o", "", "write to this file rather than standard output")
+	profile := fs.String("profile", "", "only export files made for this output profile")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	write, ok := exportFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+	q, err := qf.query()
+	if err != nil {
+		return err
+	}
+
+	lib, err := openReadOnlyLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	dls, err := lib.Find(q)
+	if err != nil {
+		return err
+	}
+
+	// Playlists refer to songs relative to where they are saved, so they
+	// can be moved along with the library.
+	var base string
+	if *format == "m3u8" || *format == "xspf" {
+		base = "."
+		if *output != "" {
+			base = filepath.Dir(*output)
+		}
+		base, err = filepath.Abs(base)
+		if err != nil {
+			return err
+		}
+	}
+	entries := lib.exportEntries(dls, *profile, base)
+
+	if *output == "" {
+		return write(os.Stdout, entries)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	err = write(f, entries)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exportEntries joins dls with their files on disk, leaving out files of
+// other profiles if profile is set. Paths are relative to base if it is
+// set.
+func (l *Library) exportEntries(dls []*Download, profile, base string) []*exportEntry {
+	var entries []*exportEntry
+	for _, dl := range dls {
+		e := &exportEntry{Download: dl, Paths: []string{}}
+		for i := range dl.Files {
+			f := &dl.Files[i]
+			if profile != "" && f.Profile != profile {
+				continue
+			}
+			path, ok := exportPath(l.absPath(f), base)
+			if !ok {
+				continue
+			}
+			e.present = append(e.present, exportFile{f, path})
+			e.Paths = append(e.Paths, path)
+		}
+		if dl.Cover != nil {
+			e.cover, _ = exportPath(l.absPath(dl.Cover), base)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// exportPath returns path relative to base, if base is set, and whether the
+// file is on disk.
+func exportPath(path, base string) (string, bool) {
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	if base != "" {
+		if rel, err := filepath.Rel(base, path); err == nil {
+			path = rel
+		}
+	}
+	return path, true
+}
+
+var csvHeader = []string{
+	"id", "state", "posted", "artist", "title", "genres", "year", "notes",
+	"subreddit", "feed", "post", "url", "media_id",
+	"path", "profile", "format", "size", "duration", "loudness",
+}
+
+// exportCSV writes a row for each file on disk, and one for each download
+// without any.
+func exportCSV(w io.Writer, entries []*exportEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, e := range entries {
+		t := e.Track
+		year := ""
+		if t.Year != 0 {
+			year = strconv.Itoa(t.Year)
+		}
+		row := []string{
+			e.ID, string(e.CurrentState()), e.Date.UTC().Format("2006-01-02T15:04:05Z"),
+			t.Artist, t.Title, strings.Join(t.Genres, "; "), year, t.Notes,
+			e.Subreddit(), e.Feed, e.Link, e.URL.String(), e.MediaID,
+		}
+		if len(e.present) == 0 {
+			cw.Write(append(row, "", "", "", "", "", ""))
+			continue
+		}
+		for _, f := range e.present {
+			duration, loudness := "", ""
+			if f.Duration > 0 {
+				duration = strconv.FormatFloat(f.Duration, 'f', 3, 64)
+			}
+			if f.Loudness != nil {
+				loudness = strconv.FormatFloat(f.Loudness.Integrated, 'f', 2, 64)
+			}
+			cw.Write(append(row[:len(row):len(row)], f.path, f.Profile, f.Format,
+				strconv.FormatInt(f.Size, 10), duration, loudness))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportJSONL writes each download's record on a line of its own.
+func exportJSONL(w io.Writer, entries []*exportEntry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportM3U writes an extended M3U playlist of the first file on disk of
+// each download.
+func exportM3U(w io.Writer, entries []*exportEntry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	for _, e := range entries {
+		if len(e.present) == 0 {
+			continue
+		}
+		// The title ends the line, so it must not break it.
+		title := strings.Join(strings.Fields(e.Track.String()), " ")
+		fmt.Fprintf(bw, "#EXTINF:%d,%s\n", e.duration(), title)
+		fmt.Fprintln(bw, e.present[0].path)
+	}
+	return bw.Flush()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location"`
+	Identifier string `xml:"identifier,omitempty"`
+	Creator    string `xml:"creator,omitempty"`
+	Title      string `xml:"title,omitempty"`
+	Annotation string `xml:"annotation,omitempty"`
+	Info       string `xml:"info,omitempty"`
+	Image      string `xml:"image,omitempty"`
+	Duration   int64  `xml:"duration,omitempty"`
+}
+
+// exportXSPF writes an XSPF playlist of the first file on disk of each
+// download.
+func exportXSPF(w io.Writer, entries []*exportEntry) error {
+	pl := xspfPlaylist{Version: 1, Title: "listentothis"}
+	for _, e := range entries {
+		if len(e.present) == 0 {
+			continue
+		}
+		f := e.present[0]
+		t := xspfTrack{
+			Location:   fileURI(f.path),
+			Identifier: e.Link,
+			Creator:    e.Track.Artist,
+			Title:      e.Track.Title,
+			Annotation: e.Title,
+			Info:       e.Link,
+		}
+		if f.Duration > 0 {
+			t.Duration = int64(math.Round(f.Duration * 1000))
+		}
+		if e.cover != "" {
+			t.Image = fileURI(e.cover)
+		}
+		pl.Tracks = append(pl.Tracks, t)
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(pl)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// fileURI returns path as a URI reference: relative if path is, and a file
+// URI otherwise.
+func fileURI(path string) string {
+	u := &url.URL{Path: filepath.ToSlash(path)}
+	if filepath.IsAbs(path) {
+		u.Scheme = "file"
+		if !strings.HasPrefix(u.Path, "/") {
+			// A Windows drive letter.
+			u.Path = "/" + u.Path
+		}
+	}
+	return u.String()
+}
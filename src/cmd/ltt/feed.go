@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SlyMarbo/rss"
+	"github.com/boltdb/bolt"
+)
+
+// ThrottledError is returned when reddit asks us to back off.
+type ThrottledError struct {
+	Status string
+
+	// RetryAfter is how long reddit asked us to wait, or zero if it did
+	// not say.
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, retry after %v", e.Status, e.RetryAfter)
+	}
+	return e.Status
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+var feedsBucket = []byte("feeds")
+
+// ErrNotModified is returned when a feed has not changed since it was last
+// fetched.
+var ErrNotModified = fmt.Errorf("not modified")
+
+// FeedCache holds the validators of the last fetched copy of a feed, which
+// are sent back to make the next fetch conditional.
+type FeedCache struct {
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	Fetched      time.Time
+}
+
+// FeedCache returns the cached validators for the feed at u, or nil if the
+// feed has not been fetched before.
+func (l *Library) FeedCache(u string) (*FeedCache, error) {
+	var fc *FeedCache
+	err := l.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(feedsBucket)
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(u))
+		if data == nil {
+			return nil
+		}
+		fc = &FeedCache{}
+		return json.Unmarshal(data, fc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// SaveFeedCache saves the validators for the feed at u.
+func (l *Library) SaveFeedCache(u string, fc *FeedCache) error {
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	return l.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(feedsBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(u), data)
+	})
+}
+
+func init() {
+	// By default, rss drops items it has parsed before in this process.
+	// The history decides what is new, and a daemon has to see posts it
+	// deferred, or that failed, again on later polls.
+	rss.CacheParsedItemIDs(false)
+}
+
+// fetchFeed fetches and parses the RSS feed of sub. If cache is not nil,
+// the request is conditional on the feed having changed since, and
+// ErrNotModified is returned if it has not. Otherwise the feed is returned
+// along with its new validators. Rate limit responses are returned as a
+// *ThrottledError.
+func fetchFeed(client *http.Client, sub *Subscription, cache *FeedCache) (*rss.Feed, *FeedCache, error) {
+	u := sub.URL()
+	fetched := &FeedCache{}
+	feed, err := rss.FetchByFunc(func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		if cache != nil {
+			if cache.ETag != "" {
+				req.Header.Set("If-None-Match", cache.ETag)
+			}
+			if cache.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cache.LastModified)
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			fetched.ETag = resp.Header.Get("ETag")
+			fetched.LastModified = resp.Header.Get("Last-Modified")
+			fetched.Fetched = time.Now()
+			return resp, nil
+		case http.StatusNotModified:
+			resp.Body.Close()
+			return nil, ErrNotModified
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			resp.Body.Close()
+			return nil, &ThrottledError{
+				Status:     resp.Status,
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch %q: %s", u, resp.Status)
+		}
+	}, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	return feed, fetched, nil
+}
+
+// poller fetches subscriptions and archives the posts they accept.
+type poller struct {
+	lib    *Library
+	client *http.Client
+	pool   *Pool
+
+	// rules apply to all subscriptions, before their own rules.
+	rules *Rules
+
+	// force fetches feeds even if they have not changed since the last
+	// poll.
+	force bool
+
+	// explain prints the rule that decided each post, instead of
+	// archiving anything.
+	explain bool
+
+	// dryRun plans what would be archived, without archiving anything or
+	// writing to the history. The plan is printed by printPlan.
+	dryRun  bool
+	plan    []planRow
+	planned map[string]string
+
+	// stop, when closed, stops a poll between downloads.
+	stop <-chan struct{}
+}
+
+func newPoller(lib *Library, cfg *Config) *poller {
+	return &poller{
+		lib:     lib,
+		client:  &http.Client{Timeout: time.Minute},
+		pool:    NewPool(lib, cfg.Concurrency, cfg.SiteConcurrency),
+		rules:   &cfg.Rules,
+		planned: map[string]string{},
+	}
+}
+
+// setStop sets the channel that stops polls and downloads when closed.
+func (p *poller) setStop(stop <-chan struct{}) {
+	p.stop = stop
+	p.pool.stop = stop
+	p.lib.stop = stop
+}
+
+func (p *poller) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// pollResult is the outcome of polling one subscription.
+type pollResult struct {
+	sub *Subscription
+
+	// feed is nil if the feed has not changed since the last poll.
+	feed *rss.Feed
+	err  error
+
+	fetched *FeedCache
+
+	// deferred is set if a post was put off because its media was being
+	// downloaded from another post. Nothing is recorded for it, so the
+	// feed must be fetched in full again to see it.
+	deferred bool
+}
+
+// pollAll fetches the feeds of subs and archives the downloads they accept,
+// along with any failed downloads due for a retry, all at once, stopping
+// early if stopped. Unless forced, fetches are
+// conditional on the feed having changed since it was last polled.
+//
+// Feed validators are only saved once all the downloads have been handled,
+// so feeds that were interrupted, or had posts put off, are fetched in full
+// next time.
+func (p *poller) pollAll(subs []*Subscription) []*pollResult {
+	switch {
+	case p.dryRun:
+		p.planRetries()
+	case !p.explain:
+		p.submitRetries()
+	}
+	var results []*pollResult
+	for _, sub := range subs {
+		if p.stopped() {
+			break
+		}
+		r := &pollResult{sub: sub}
+		results = append(results, r)
+		r.feed, r.fetched, r.err = p.fetch(sub)
+		if r.feed == nil {
+			continue
+		}
+		for _, item := range r.feed.Items {
+			dl, err := ParseDownload(item)
+			if err != nil && p.dryRun {
+				p.plan = append(p.plan, planRow{sub.DisplayName(), item.ID, PlanUnsupported, item.Title, err.Error(), ""})
+				continue
+			} else if err != nil {
+				log.Printf("don't know how to download %q: %v", item.ID, err)
+				continue
+			}
+			if p.accept(sub, dl) && p.pool.Submit(dl) == ErrInProgress {
+				r.deferred = true
+			}
+		}
+	}
+
+	summary := p.pool.Wait()
+	if !summary.Empty() {
+		log.Printf("%s", summary)
+	}
+	if p.explain || p.dryRun || p.stopped() {
+		return results
+	}
+	p.lib.retain()
+	for _, r := range results {
+		if r.feed == nil || (r.fetched.ETag == "" && r.fetched.LastModified == "") {
+			continue
+		}
+		if r.deferred {
+			log.Printf("%q has reposts of songs still downloading, so it will be fetched in full next time", r.sub.DisplayName())
+			continue
+		}
+		r.err = p.lib.SaveFeedCache(r.sub.URL(), r.fetched)
+	}
+	return results
+}
+
+// fetch fetches the feed of sub, unless it has not changed since the last
+// poll, in which case the feed returned is nil.
+func (p *poller) fetch(sub *Subscription) (*rss.Feed, *FeedCache, error) {
+	var cache *FeedCache
+	if !p.force && !p.explain && !p.dryRun {
+		var err error
+		cache, err = p.lib.FeedCache(sub.URL())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	feed, fetched, err := fetchFeed(p.client, sub, cache)
+	if err == ErrNotModified {
+		log.Printf("%q has not changed", sub.DisplayName())
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return feed, fetched, nil
+}
+
+// accept checks dl against the rules of p and sub, and returns whether it
+// should be archived. In explain mode, the decision is printed, and in a
+// dry run it is planned, and nothing is accepted.
+func (p *poller) accept(sub *Subscription, dl *Download) bool {
+	decision := checkRules(dl, p.rules, &sub.Rules)
+	if p.explain {
+		fmt.Printf("%s\t%s\t%s\t%s\n", sub.DisplayName(), dl.ID, dl.Title, decision)
+		return false
+	}
+	if p.dryRun {
+		if !decision.Accept {
+			p.addPlan(sub.DisplayName(), dl, PlanSkip, decision.String())
+			return false
+		}
+		action, reason, err := p.lib.plan(dl)
+		if err != nil {
+			log.Printf("failed to plan %q: %v", dl.ID, err)
+			return false
+		}
+		p.addPlan(sub.DisplayName(), dl, action, reason)
+		return false
+	}
+	if !decision.Accept {
+		log.Printf("skipping %q from %q: %s", dl.ID, sub.DisplayName(), decision)
+		err := p.lib.Skip(dl, fmt.Errorf("%s", decision))
+		// Posts already downloaded, or linked to a download, stay so.
+		if err != nil && err != ErrAlreadyDownloaded && err != ErrRepost {
+			log.Printf("failed to record skip of %q: %v", dl.ID, err)
+		}
+		return false
+	}
+	dl.Feed = sub.DisplayName()
+	dl.Folder = sub.Folder
+	return true
+}
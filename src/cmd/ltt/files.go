@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// filesBucket indexes the history by file path, relative to the library.
+var filesBucket = []byte("files")
+
+// File is a file downloaded into the library.
+type File struct {
+	// Path is relative to the library, with forward slashes.
+	Path string
+
+	Size int64
+
+	// Duration is the play time in seconds, or 0 if it is not known.
+	Duration float64
+
+	// Format is the file extension, such as "ogg" or "mp3".
+	Format string
+
+	// SHA256 is the hex encoded hash of the file contents.
+	SHA256 string
+
+	// Profile names the output profile the file was made for.
+	Profile string `json:",omitempty"`
+
+	// Loudness is the measured loudness, for players to level songs by.
+	Loudness *Loudness `json:",omitempty"`
+}
+
+// relPath returns path relative to the library, with forward slashes.
+func (l *Library) relPath(path string) (string, error) {
+	rel, err := filepath.Rel(l.Path, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is outside the library", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// absPath returns the path of f on disk.
+func (l *Library) absPath(f *File) string {
+	return filepath.Join(l.Path, filepath.FromSlash(f.Path))
+}
+
+// describeFile returns a File describing path, which must be inside the
+// library.
+func (l *Library) describeFile(path string) (*File, error) {
+	rel, err := l.relPath(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{
+		Path:   rel,
+		Size:   info.Size(),
+		Format: strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."),
+		SHA256: sum,
+	}
+	// Not knowing the duration is no reason to lose the download.
+	f.Duration, _ = probeDuration(path)
+	return f, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// probeDuration returns the duration of an audio file in seconds, using
+// ffprobe, which youtube-dl needs for extracting audio anyway.
+func probeDuration(path string) (float64, error) {
+	out, err := childOutput(childCommand("ffprobe", "-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", path))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// allFiles returns the files of dl, and its cover if it has one.
+func (dl *Download) allFiles() []File {
+	if dl.Cover == nil {
+		return dl.Files
+	}
+	return append(dl.Files[:len(dl.Files):len(dl.Files)], *dl.Cover)
+}
+
+// putRecord writes the history record of dl, keeping the file index in
+// step with it.
+func putRecord(tx *bolt.Tx, b *bolt.Bucket, dl *Download, data []byte) error {
+	idx, err := tx.CreateBucketIfNotExists(filesBucket)
+	if err != nil {
+		return err
+	}
+	if prev, err := getRecord(b, dl.ID); err != nil {
+		return err
+	} else if prev != nil {
+		for _, f := range prev.allFiles() {
+			if string(idx.Get([]byte(f.Path))) == dl.ID {
+				err = idx.Delete([]byte(f.Path))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, f := range dl.allFiles() {
+		err = idx.Put([]byte(f.Path), []byte(dl.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return b.Put([]byte(dl.ID), data)
+}
+
+// ByFile returns the download that wrote the file at path, relative to the
+// library, or nil if there is none.
+func (l *Library) ByFile(path string) (*Download, error) {
+	var dl *Download
+	err := l.View(func(tx *bolt.Tx) error {
+		idx, b := tx.Bucket(filesBucket), tx.Bucket(downloadedBucket)
+		if idx == nil || b == nil {
+			return nil
+		}
+		id := idx.Get([]byte(filepath.ToSlash(path)))
+		if id == nil {
+			return nil
+		}
+		var err error
+		dl, err = getRecord(b, string(id))
+		return err
+	})
+	return dl, err
+}
+
+// FindFile returns the first file of dl on disk, or nil if it has none.
+func (l *Library) FindFile(dl *Download) *File {
+	for i := range dl.Files {
+		if _, err := os.Stat(l.absPath(&dl.Files[i])); err == nil {
+			return &dl.Files[i]
+		}
+	}
+	return nil
+}
+
+// SaveFiles records the files and cover of dl, as they are now, and whether
+// they were evicted, in the history.
+func (l *Library) SaveFiles(dl *Download) error {
+	return l.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return fmt.Errorf("no record of %q", dl.ID)
+		}
+		prev, err := getRecord(b, dl.ID)
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			return fmt.Errorf("no record of %q", dl.ID)
+		}
+		prev.Files = dl.Files
+		prev.Cover = dl.Cover
+		prev.Downloaded = dl.Downloaded
+		prev.Evicted = dl.Evicted
+		data, err := json.Marshal(prev)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, b, prev, data)
+	})
+}
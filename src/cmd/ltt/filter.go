@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rules decide which posts are downloaded. Exclusions are checked first, and
+// the first one that matches skips the post. Then, if any inclusions are
+// set, the post must match at least one of each kind that is set.
+//
+// All string matches ignore case.
+type Rules struct {
+	// Genres, if not empty, limits downloads to posts with a genre
+	// containing one of these, so "rock" includes "Indie Rock".
+	Genres []string `json:"genres,omitempty"`
+
+	// ExcludeGenres skips posts with a genre containing any of these.
+	ExcludeGenres []string `json:"exclude_genres,omitempty"`
+
+	// MinYear and MaxYear skip posts released outside of the range. Posts
+	// without a year are not skipped.
+	MinYear int `json:"min_year,omitempty"`
+	MaxYear int `json:"max_year,omitempty"`
+
+	// ExcludeArtists skips posts by these artists.
+	ExcludeArtists []string `json:"exclude_artists,omitempty"`
+
+	// ExcludeDomains skips posts linking to these domains or their
+	// subdomains. Links are matched after they are normalized, so a
+	// domain that a resolver handles, such as "youtu.be", stands for the
+	// whole site: it skips youtube.com links as well, and the other way
+	// around.
+	ExcludeDomains []string `json:"exclude_domains,omitempty"`
+
+	// Include, if not empty, limits downloads to posts whose title
+	// contains at least one of these strings.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude skips posts whose title contains any of these strings.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Match, if not empty, limits downloads to posts whose title matches
+	// at least one of these regular expressions.
+	Match []string `json:"match,omitempty"`
+
+	// ExcludeMatch skips posts whose title matches any of these regular
+	// expressions.
+	ExcludeMatch []string `json:"exclude_match,omitempty"`
+
+	match, excludeMatch []*regexp.Regexp
+}
+
+// Decision is the outcome of checking a post against Rules.
+type Decision struct {
+	Accept bool
+
+	// Rule names the rule that decided, such as `exclude_genres "metal"`.
+	// It is empty when a post was accepted because nothing excluded it
+	// and no inclusions were set.
+	Rule string
+
+	// Reason explains the decision.
+	Reason string
+}
+
+func (d Decision) String() string {
+	verdict := "skip"
+	if d.Accept {
+		verdict = "accept"
+	}
+	if d.Rule == "" {
+		return verdict + ": " + d.Reason
+	}
+	return fmt.Sprintf("%s: %s (%s)", verdict, d.Reason, d.Rule)
+}
+
+func skip(rule, format string, args ...interface{}) Decision {
+	return Decision{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (r *Rules) compile() error {
+	var err error
+	r.match, err = compileAll(r.Match)
+	if err != nil {
+		return err
+	}
+	r.excludeMatch, err = compileAll(r.ExcludeMatch)
+	return err
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid title pattern %q: %v", expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Check checks dl against the rules.
+func (r *Rules) Check(dl *Download) Decision {
+	t := dl.Track
+	title := strings.ToLower(dl.Title)
+
+	for _, g := range r.ExcludeGenres {
+		if genre := matchGenre(t, g); genre != "" {
+			return skip(fmt.Sprintf("exclude_genres %q", g), "genre is %q", genre)
+		}
+	}
+	if r.MinYear != 0 && t.Year != 0 && t.Year < r.MinYear {
+		return skip(fmt.Sprintf("min_year %d", r.MinYear), "released in %d", t.Year)
+	}
+	if r.MaxYear != 0 && t.Year != 0 && t.Year > r.MaxYear {
+		return skip(fmt.Sprintf("max_year %d", r.MaxYear), "released in %d", t.Year)
+	}
+	for _, a := range r.ExcludeArtists {
+		if t.Artist != "" && strings.EqualFold(t.Artist, a) {
+			return skip(fmt.Sprintf("exclude_artists %q", a), "artist is %q", t.Artist)
+		}
+	}
+	host := strings.ToLower(dl.URL.Host)
+	for _, d := range r.ExcludeDomains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) || linksToSite(dl, d) {
+			return skip(fmt.Sprintf("exclude_domains %q", d), "links to %s", host)
+		}
+	}
+	for _, exc := range r.Exclude {
+		if strings.Contains(title, strings.ToLower(exc)) {
+			return skip(fmt.Sprintf("exclude %q", exc), "title contains %q", exc)
+		}
+	}
+	for i, re := range r.excludeMatch {
+		if re.MatchString(dl.Title) {
+			return skip(fmt.Sprintf("exclude_match %q", r.ExcludeMatch[i]), "title matches")
+		}
+	}
+
+	var matched []string
+	if len(r.Genres) > 0 {
+		rule := ""
+		for _, g := range r.Genres {
+			if matchGenre(t, g) != "" {
+				rule = fmt.Sprintf("genres %q", g)
+				break
+			}
+		}
+		if rule == "" {
+			return skip("genres", "no genre matches %q", r.Genres)
+		}
+		matched = append(matched, rule)
+	}
+	if len(r.Include) > 0 {
+		rule := ""
+		for _, inc := range r.Include {
+			if strings.Contains(title, strings.ToLower(inc)) {
+				rule = fmt.Sprintf("include %q", inc)
+				break
+			}
+		}
+		if rule == "" {
+			return skip("include", "title contains none of %q", r.Include)
+		}
+		matched = append(matched, rule)
+	}
+	if len(r.match) > 0 {
+		rule := ""
+		for i, re := range r.match {
+			if re.MatchString(dl.Title) {
+				rule = fmt.Sprintf("match %q", r.Match[i])
+				break
+			}
+		}
+		if rule == "" {
+			return skip("match", "title matches none of %q", r.Match)
+		}
+		matched = append(matched, rule)
+	}
+
+	if len(matched) == 0 {
+		return Decision{Accept: true, Reason: "no rule excludes it"}
+	}
+	return Decision{Accept: true, Rule: strings.Join(matched, ", "), Reason: "included"}
+}
+
+// linksToSite returns whether dl was resolved by the resolver registered
+// for domain, which is how a posted youtu.be link is known after it was
+// normalized to youtube.com.
+func linksToSite(dl *Download, domain string) bool {
+	r, ok := resolvers[domain]
+	return ok && dl.site() == r.Name()
+}
+
+// matchGenre returns the first genre of t containing g, or the empty string
+// if there is none.
+func matchGenre(t Track, g string) string {
+	g = strings.ToLower(g)
+	for _, genre := range t.Genres {
+		if strings.Contains(strings.ToLower(genre), g) {
+			return genre
+		}
+	}
+	return ""
+}
+
+// checkRules checks dl against each set of rules in turn. The first set
+// that skips dl decides; otherwise the last set that included it does.
+func checkRules(dl *Download, sets ...*Rules) Decision {
+	decision := Decision{Accept: true, Reason: "no rule excludes it"}
+	for _, rules := range sets {
+		if rules == nil {
+			continue
+		}
+		d := rules.Check(dl)
+		if !d.Accept {
+			return d
+		}
+		if d.Rule != "" {
+			decision = d
+		}
+	}
+	return decision
+}
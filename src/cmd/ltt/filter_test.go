@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestExcludeDomains(t *testing.T) {
+	tests := []struct {
+		domain, link string
+		skip         bool
+	}{
+		{"youtube.com", "https://www.youtube.com/watch?v=dQw4w9WgXcQ", true},
+		// youtu.be links are normalized to youtube.com, but are still
+		// YouTube.
+		{"youtu.be", "https://youtu.be/dQw4w9WgXcQ", true},
+		{"youtu.be", "https://www.youtube.com/watch?v=dQw4w9WgXcQ", true},
+		{"YouTube.com", "https://youtu.be/dQw4w9WgXcQ", true},
+		{"bandcamp.com", "https://artist.bandcamp.com/track/song", true},
+		{"artist.bandcamp.com", "https://artist.bandcamp.com/track/song", true},
+		{"artist.bandcamp.com", "https://other.bandcamp.com/track/song", false},
+		{"soundcloud.com", "https://www.youtube.com/watch?v=dQw4w9WgXcQ", false},
+		{"example.com", "https://cdn.example.com/song.mp3", true},
+		{"example.com", "https://example.org/song.mp3", false},
+	}
+	for _, tt := range tests {
+		r := &Rules{ExcludeDomains: []string{tt.domain}}
+		d := r.Check(testPost(t, "a", tt.link))
+		if d.Accept == tt.skip {
+			t.Errorf("exclude_domains %q on %s: %v", tt.domain, tt.link, d)
+		}
+	}
+}
+
+func TestCheckRulesOrder(t *testing.T) {
+	dl := testPost(t, "a", "https://youtu.be/dQw4w9WgXcQ")
+	dl.Track = Track{Artist: "Artist", Title: "Song", Genres: []string{"Indie Rock", "Folk"}}
+
+	rock := &Rules{Genres: []string{"rock"}}
+	folk := &Rules{Genres: []string{"folk"}}
+	noFolk := &Rules{ExcludeGenres: []string{"folk"}}
+	noArtist := &Rules{ExcludeArtists: []string{"artist"}}
+	tests := []struct {
+		name   string
+		sets   []*Rules
+		accept bool
+		rule   string
+	}{
+		{"no rules", nil, true, ""},
+		{"nil sets", []*Rules{nil, nil}, true, ""},
+		{"first skip wins", []*Rules{noFolk, noArtist}, false, `exclude_genres "folk"`},
+		{"first skip wins in either order", []*Rules{noArtist, noFolk}, false, `exclude_artists "artist"`},
+		{"skip after inclusion", []*Rules{rock, noArtist}, false, `exclude_artists "artist"`},
+		{"skip before inclusion", []*Rules{noFolk, rock}, false, `exclude_genres "folk"`},
+		{"last inclusion decides", []*Rules{rock, folk}, true, `genres "folk"`},
+		{"last inclusion decides in either order", []*Rules{folk, rock}, true, `genres "rock"`},
+		{"inclusion survives a set without rules", []*Rules{rock, {}}, true, `genres "rock"`},
+		{"failed inclusion skips", []*Rules{rock, {Genres: []string{"metal"}}}, false, "genres"},
+	}
+	for _, tt := range tests {
+		d := checkRules(dl, tt.sets...)
+		if d.Accept != tt.accept || d.Rule != tt.rule {
+			t.Errorf("%s: %v, want accept %v by %q", tt.name, d, tt.accept, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FLAC metadata block types.
+const (
+	flacStreamInfo    = 0
+	flacPadding       = 1
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+type flacBlock struct {
+	typ  byte
+	data []byte
+}
+
+// readFLACBlocks reads the metadata blocks at the start of a FLAC file,
+// leaving r at the first audio frame.
+func readFLACBlocks(r io.Reader) ([]flacBlock, error) {
+	var magic [4]byte
+	_, err := io.ReadFull(r, magic[:])
+	if err != nil || string(magic[:]) != "fLaC" {
+		return nil, fmt.Errorf("not a FLAC file")
+	}
+	var blocks []flacBlock
+	for {
+		var h [4]byte
+		_, err = io.ReadFull(r, h[:])
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		b := flacBlock{typ: h[0] & 0x7f}
+		b.data = make([]byte, int(h[1])<<16|int(h[2])<<8|int(h[3]))
+		_, err = io.ReadFull(r, b.data)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		blocks = append(blocks, b)
+		if h[0]&0x80 != 0 {
+			return blocks, nil
+		}
+	}
+}
+
+func writeFLACBlocks(w io.Writer, blocks []flacBlock) error {
+	_, err := io.WriteString(w, "fLaC")
+	if err != nil {
+		return err
+	}
+	for i, b := range blocks {
+		if len(b.data) >= 1<<24 {
+			return fmt.Errorf("FLAC metadata block too large")
+		}
+		h := []byte{b.typ, byte(len(b.data) >> 16), byte(len(b.data) >> 8), byte(len(b.data))}
+		if i == len(blocks)-1 {
+			h[0] |= 0x80
+		}
+		_, err = w.Write(h)
+		if err == nil {
+			_, err = w.Write(b.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFLACTags returns the Vorbis comments of the FLAC file at path.
+func readFLACTags(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	blocks, err := readFLACBlocks(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.typ == flacVorbisComment {
+			_, comments, err := parseVorbisComment(b.data)
+			return comments, err
+		}
+	}
+	return nil, nil
+}
+
+// writeFLACTags rewrites the Vorbis comment block of the FLAC file at path
+// with tags, keeping other comments, and replaces its pictures with the
+// cover, if tags have one. Padding is dropped, since the file is rewritten
+// anyway.
+func writeFLACTags(path string, tags *Tags) error {
+	return rewriteFile(path, func(r *bufio.Reader, w io.Writer) error {
+		blocks, err := readFLACBlocks(r)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 || blocks[0].typ != flacStreamInfo {
+			return fmt.Errorf("FLAC file does not start with STREAMINFO")
+		}
+		vendor := "ltt"
+		var comments []string
+		kept := blocks[:1]
+		for _, b := range blocks[1:] {
+			switch b.typ {
+			case flacVorbisComment:
+				vendor, comments, err = parseVorbisComment(b.data)
+				if err != nil {
+					return err
+				}
+			case flacPadding:
+			case flacPicture:
+				if tags.Cover == nil {
+					kept = append(kept, b)
+				}
+			default:
+				kept = append(kept, b)
+			}
+		}
+		comment := flacBlock{flacVorbisComment, buildVorbisComment(vendor, tags.merge(comments))}
+		blocks = append([]flacBlock{kept[0], comment}, kept[1:]...)
+		if tags.Cover != nil {
+			blocks = append(blocks, flacBlock{flacPicture, encodeFLACPicture(tags.Cover)})
+		}
+		err = writeFLACBlocks(w, blocks)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// flacApplication is the type of APPLICATION blocks, which ltt keeps as
+// they are.
+const flacApplication = 2
+
+// writeTestFLAC writes a FLAC file with PADDING and PICTURE blocks around
+// its comments, as encoders and taggers leave them, and returns the path
+// and the audio after the metadata.
+func writeTestFLAC(t *testing.T) (string, []byte) {
+	old := &Picture{MIME: "image/png", Width: 2, Height: 2, Data: []byte("old cover")}
+	blocks := []flacBlock{
+		{flacStreamInfo, make([]byte, 34)},
+		{flacPadding, make([]byte, 8192)},
+		{flacVorbisComment, buildVorbisComment("reference libFLAC", []string{"ARTIST=Old", "ENCODER=flac"})},
+		{flacPicture, encodeFLACPicture(old)},
+		{flacApplication, []byte("testdata")},
+		{flacPadding, make([]byte, 100)},
+	}
+	var b bytes.Buffer
+	err := writeFLACBlocks(&b, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := []byte{0xff, 0xf8, 0x69, 0x18, 0, 0, 1, 2, 3}
+	b.Write(audio)
+	path := filepath.Join(t.TempDir(), "song.flac")
+	err = ioutil.WriteFile(path, b.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, audio
+}
+
+// readTestFLAC returns the metadata blocks of the FLAC file at path, and
+// the audio after them.
+func readTestFLAC(t *testing.T, path string) ([]flacBlock, []byte) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	blocks, err := readFLACBlocks(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks, rest
+}
+
+func flacTypes(blocks []flacBlock) []byte {
+	var types []byte
+	for _, b := range blocks {
+		types = append(types, b.typ)
+	}
+	return types
+}
+
+func TestWriteFLACTagsWithCover(t *testing.T) {
+	path, audio := writeTestFLAC(t)
+	cover := &Picture{MIME: "image/jpeg", Width: 600, Height: 600, Data: []byte("new cover")}
+	tags := &Tags{Cover: cover}
+	tags.Add("ARTIST", "New")
+	tags.Add("GENRE", "Folk")
+	err := writeFLACTags(path, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, rest := readTestFLAC(t, path)
+	// Padding goes, the old picture gives way to the cover, and the
+	// comments follow STREAMINFO.
+	want := []byte{flacStreamInfo, flacVorbisComment, flacApplication, flacPicture}
+	if got := flacTypes(blocks); !bytes.Equal(got, want) {
+		t.Fatalf("blocks %v, want %v", got, want)
+	}
+	if !bytes.Equal(blocks[3].data, encodeFLACPicture(cover)) {
+		t.Errorf("picture is not the cover")
+	}
+	if string(blocks[2].data) != "testdata" {
+		t.Errorf("APPLICATION block changed")
+	}
+	if !bytes.Equal(rest, audio) {
+		t.Errorf("audio changed")
+	}
+
+	vendor, comments, err := parseVorbisComment(blocks[1].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendor != "reference libFLAC" {
+		t.Errorf("vendor %q", vendor)
+	}
+	if want := []string{"ENCODER=flac", "ARTIST=New", "GENRE=Folk"}; !reflect.DeepEqual(comments, want) {
+		t.Errorf("comments %q, want %q", comments, want)
+	}
+	read, err := readFLACTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, comments) {
+		t.Errorf("readFLACTags returned %q", read)
+	}
+}
+
+func TestWriteFLACTagsKeepsPicture(t *testing.T) {
+	path, audio := writeTestFLAC(t)
+	tags := &Tags{}
+	tags.Add("TITLE", "Song")
+	err := writeFLACTags(path, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, rest := readTestFLAC(t, path)
+	want := []byte{flacStreamInfo, flacVorbisComment, flacPicture, flacApplication}
+	if got := flacTypes(blocks); !bytes.Equal(got, want) {
+		t.Fatalf("blocks %v, want %v", got, want)
+	}
+	if !bytes.Contains(blocks[2].data, []byte("old cover")) {
+		t.Errorf("old picture not kept")
+	}
+	if !bytes.Equal(rest, audio) {
+		t.Errorf("audio changed")
+	}
+}
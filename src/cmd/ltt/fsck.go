@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"audio"
+)
+
+// quarantineDir is where fsck -repair moves leftovers, relative to the
+// library. Being hidden, nothing else looks in it.
+const quarantineDir = ".quarantine"
+
+// Kinds of problem fsck finds.
+const (
+	FsckMissing   = "missing"
+	FsckMoved     = "moved"
+	FsckChanged   = "changed"
+	FsckUntracked = "untracked"
+	FsckLeftover  = "leftover"
+)
+
+// fsckProblem is a difference between the history and the library on disk.
+type fsckProblem struct {
+	kind   string
+	path   string
+	id     string
+	detail string
+
+	repaired bool
+}
+
+// isLeftover returns whether the file name is one a download, transcode or
+// tagging run leaves behind when it is interrupted.
+func isLeftover(name string) bool {
+	for _, suffix := range []string{".part", ".ytdl", ".tagging"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	// youtube-dl's fragments and intermediate files.
+	return strings.Contains(name, ".part-Frag") || strings.Contains(name, ".temp.")
+}
+
+// fsck is a check of the library against the history.
+type fsck struct {
+	lib    *Library
+	repair bool
+	quick  bool
+
+	// untracked are the files on disk no record has, by path relative to
+	// the library. Files found to have moved are taken out.
+	untracked map[string]os.FileInfo
+
+	problems []*fsckProblem
+}
+
+// scan lists the files in the library, skipping the history and anything
+// else hidden.
+func (c *fsck) scan() (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.Walk(c.lib.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != c.lib.Path {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := c.lib.relPath(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	return files, err
+}
+
+func (c *fsck) report(kind, path, id, detail string) *fsckProblem {
+	p := &fsckProblem{kind: kind, path: path, id: id, detail: detail}
+	c.problems = append(c.problems, p)
+	return p
+}
+
+// run checks the library, repairing what it can if c.repair is set.
+func (c *fsck) run() error {
+	files, err := c.scan()
+	if err != nil {
+		return err
+	}
+	dls, err := c.lib.Downloads()
+	if err != nil {
+		return err
+	}
+	c.untracked = map[string]os.FileInfo{}
+	for rel, info := range files {
+		c.untracked[rel] = info
+	}
+	for _, dl := range dls {
+		for _, f := range dl.allFiles() {
+			delete(c.untracked, f.Path)
+		}
+	}
+
+	for _, dl := range dls {
+		err = c.checkDownload(dl)
+		if err != nil {
+			return err
+		}
+	}
+
+	for rel, info := range c.untracked {
+		switch {
+		case isLeftover(info.Name()):
+			p := c.report(FsckLeftover, rel, "", "")
+			if c.repair {
+				to := filepath.Join(c.lib.Path, quarantineDir, filepath.FromSlash(rel))
+				err = os.MkdirAll(filepath.Dir(to), 0755)
+				if err == nil {
+					err = os.Rename(filepath.Join(c.lib.Path, filepath.FromSlash(rel)), to)
+				}
+				if err != nil {
+					return err
+				}
+				p.detail, p.repaired = "quarantined in "+quarantineDir, true
+			}
+		case audio.IsFile(rel):
+			c.report(FsckUntracked, rel, "", "no record; see ltt import")
+		}
+	}
+	sort.SliceStable(c.problems, func(i, j int) bool { return c.problems[i].path < c.problems[j].path })
+	return nil
+}
+
+// checkDownload checks the files of dl against the disk.
+func (c *fsck) checkDownload(dl *Download) error {
+	dirty := false
+	var kept []File
+	for i := range dl.Files {
+		keep, changed, err := c.checkFile(dl, &dl.Files[i])
+		if err != nil {
+			return err
+		}
+		if keep {
+			kept = append(kept, dl.Files[i])
+		}
+		dirty = dirty || changed
+	}
+	dl.Files = kept
+	if dl.Cover != nil {
+		keep, changed, err := c.checkFile(dl, dl.Cover)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			dl.Cover = nil
+		}
+		dirty = dirty || changed
+	}
+	if dirty && c.repair {
+		return c.lib.SaveFiles(dl)
+	}
+	return nil
+}
+
+// checkFile checks f, a file of dl. It returns whether f is still to be
+// recorded, and whether it was changed, when repairing.
+func (c *fsck) checkFile(dl *Download, f *File) (keep, changed bool, err error) {
+	info, err := os.Stat(c.lib.absPath(f))
+	if os.IsNotExist(err) {
+		to, err := c.findMoved(f)
+		if err != nil {
+			return false, false, err
+		}
+		if to != "" {
+			p := c.report(FsckMoved, f.Path, dl.ID, "to "+to)
+			if c.repair {
+				f.Path, p.repaired = to, true
+				return true, true, nil
+			}
+			return true, false, nil
+		}
+		p := c.report(FsckMissing, f.Path, dl.ID, "")
+		if c.repair {
+			p.detail, p.repaired = "dropped from the record", true
+			return false, true, nil
+		}
+		return true, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+
+	var detail string
+	if info.Size() != f.Size {
+		detail = fmt.Sprintf("size %d, recorded %d", info.Size(), f.Size)
+	} else if !c.quick && f.SHA256 != "" {
+		sum, err := hashFile(c.lib.absPath(f))
+		if err != nil {
+			return false, false, err
+		}
+		if sum != f.SHA256 {
+			detail = "contents differ from the download"
+		}
+	}
+	if detail == "" {
+		return true, false, nil
+	}
+	p := c.report(FsckChanged, f.Path, dl.ID, detail)
+	if !c.repair {
+		return true, false, nil
+	}
+	// The file on disk is what there is now, edited by hand perhaps.
+	nf, err := c.lib.describeFile(c.lib.absPath(f))
+	if err != nil {
+		return false, false, err
+	}
+	nf.Profile = f.Profile
+	*f, p.repaired = *nf, true
+	p.detail += "; recorded anew"
+	return true, true, nil
+}
+
+// findMoved looks for where f went among the untracked files: by name
+// first, as meh moves songs to Keep/ and Trash/, then anywhere. The file
+// must be the same size and, if its hash is known, have the same contents.
+// It returns the new path, or the empty string if f is nowhere.
+func (c *fsck) findMoved(f *File) (string, error) {
+	var byName, bySize []string
+	for rel, info := range c.untracked {
+		if info.Size() != f.Size || isLeftover(info.Name()) {
+			continue
+		}
+		if path.Base(rel) == path.Base(f.Path) {
+			byName = append(byName, rel)
+		} else if f.SHA256 != "" {
+			bySize = append(bySize, rel)
+		}
+	}
+	sort.Strings(byName)
+	sort.Strings(bySize)
+	for _, rel := range append(byName, bySize...) {
+		if f.SHA256 != "" {
+			sum, err := hashFile(filepath.Join(c.lib.Path, filepath.FromSlash(rel)))
+			if err != nil {
+				return "", err
+			}
+			if sum != f.SHA256 {
+				continue
+			}
+		}
+		delete(c.untracked, rel)
+		return rel, nil
+	}
+	return "", nil
+}
+
+func runFsck(cfg *Config, args []string) error {
+	fs := newFlagSet("fsck")
+	repair := fs.Bool("repair", false, "relocate moved files, forget missing ones, and quarantine leftovers")
+	quick := fs.Bool("quick", false, "compare sizes only, without hashing files")
+	fs.Parse(args)
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	c := &fsck{lib: lib, repair: *repair, quick: *quick}
+	err = c.run()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	unrepaired := 0
+	if len(c.problems) > 0 {
+		fmt.Fprintln(w, "PROBLEM\tPATH\tID\tDETAIL")
+	}
+	for _, p := range c.problems {
+		if !p.repaired {
+			unrepaired++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.kind, p.path, p.id, p.detail)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	if unrepaired > 0 {
+		if *repair {
+			return fmt.Errorf("%d problems left", unrepaired)
+		}
+		return fmt.Errorf("%d problems found; run with -repair to fix what can be fixed", unrepaired)
+	}
+	if len(c.problems) == 0 {
+		fmt.Println("no problems found")
+		return nil
+	}
+	fmt.Printf("%d problems repaired\n", len(c.problems))
+	return nil
+}
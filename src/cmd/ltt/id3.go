@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3Frames map Vorbis comment names to ID3v2.4 text frames. Other names
+// are written as TXXX frames.
+var id3Frames = map[string]string{
+	"ARTIST":      "TPE1",
+	"TITLE":       "TIT2",
+	"GENRE":       "TCON",
+	"DATE":        "TDRC",
+	"ALBUM":       "TALB",
+	"ALBUMARTIST": "TPE2",
+}
+
+// id3UTF8 is the ID3v2.4 text encoding byte for UTF-8.
+const id3UTF8 = 3
+
+// writeID3Tags replaces any ID3v2 tag at the start of the MP3 file at path
+// with one holding tags.
+func writeID3Tags(path string, tags *Tags) error {
+	return rewriteFile(path, func(r *bufio.Reader, w io.Writer) error {
+		head, err := r.Peek(10)
+		if err == nil && string(head[:3]) == "ID3" {
+			size := 10 + syncsafe(head[6:10])
+			if head[5]&0x10 != 0 {
+				// A footer follows.
+				size += 10
+			}
+			_, err = r.Discard(size)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+		}
+		_, err = w.Write(id3Tag(tags))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
+
+// id3Tag returns an ID3v2.4 tag holding tags and their cover. Several
+// values for one name go in one frame, separated by NULs.
+func id3Tag(tags *Tags) []byte {
+	var names []string
+	values := map[string][]string{}
+	for _, f := range tags.fields {
+		if values[f.name] == nil {
+			names = append(names, f.name)
+		}
+		values[f.name] = append(values[f.name], f.value)
+	}
+
+	var frames bytes.Buffer
+	for _, name := range names {
+		value := strings.Join(values[name], "\x00")
+		switch id := id3Frames[name]; {
+		case id != "":
+			writeID3Frame(&frames, id, append([]byte{id3UTF8}, value...))
+		case name == "COMMENT":
+			writeID3Frame(&frames, "COMM", append([]byte{id3UTF8, 'e', 'n', 'g', 0}, value...))
+		case name == "URL":
+			// URL frames are always ISO-8859-1, and URLs are ASCII.
+			writeID3Frame(&frames, "WOAS", []byte(values[name][0]))
+		default:
+			data := append([]byte{id3UTF8}, name...)
+			data = append(data, 0)
+			writeID3Frame(&frames, "TXXX", append(data, value...))
+		}
+	}
+
+	if p := tags.Cover; p != nil {
+		data := append([]byte{id3UTF8}, p.MIME...)
+		// Front cover, with no description.
+		data = append(data, 0, 3, 0)
+		writeID3Frame(&frames, "APIC", append(data, p.Data...))
+	}
+
+	tag := []byte{'I', 'D', '3', 4, 0, 0}
+	tag = append(tag, putSyncsafe(frames.Len())...)
+	return append(tag, frames.Bytes()...)
+}
+
+func writeID3Frame(w *bytes.Buffer, id string, data []byte) {
+	w.WriteString(id)
+	w.Write(putSyncsafe(len(data)))
+	w.Write([]byte{0, 0})
+	w.Write(data)
+}
+
+// syncsafe decodes a 28-bit ID3 size, stored 7 bits to a byte.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSyncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+// readID3Tags returns the text frames of the ID3v2.3 or v2.4 tag at the
+// start of the MP3 file at path as Vorbis comments, the reverse of id3Tag.
+func readID3Tags(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var h [10]byte
+	_, err = io.ReadFull(f, h[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(h[:3]) != "ID3" {
+		return nil, nil
+	}
+	version := h[3]
+	if version != 3 && version != 4 {
+		return nil, fmt.Errorf("unsupported ID3v2.%d tag", version)
+	}
+	body := make([]byte, syncsafe(h[6:10]))
+	_, err = io.ReadFull(f, body)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if version == 3 && h[5]&0x80 != 0 {
+		body = unsynchronize(body)
+	}
+	if h[5]&0x40 != 0 {
+		// Skip the extended header.
+		if len(body) < 4 {
+			return nil, fmt.Errorf("truncated ID3 tag")
+		}
+		n := syncsafe(body)
+		if version == 3 {
+			n = 4 + int(binary.BigEndian.Uint32(body))
+		}
+		if n > len(body) {
+			return nil, fmt.Errorf("truncated ID3 tag")
+		}
+		body = body[n:]
+	}
+
+	names := map[string]string{"TYER": "DATE"}
+	for name, id := range id3Frames {
+		names[id] = name
+	}
+	var comments []string
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := syncsafe(body[4:8])
+		if version == 3 {
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		if size > len(body)-10 {
+			return nil, fmt.Errorf("truncated ID3 frame %q", id)
+		}
+		format := body[9]
+		data := body[10 : 10+size]
+		body = body[10+size:]
+
+		if version == 3 {
+			if format&0xc0 != 0 {
+				// Compressed or encrypted.
+				continue
+			}
+			if format&0x20 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+		} else {
+			if format&0x0c != 0 {
+				continue
+			}
+			if format&0x40 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+			if format&0x02 != 0 {
+				data = unsynchronize(data)
+			}
+			if format&0x01 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch {
+		case id == "TXXX":
+			desc, value := splitID3Text(data[0], data[1:])
+			comments = append(comments, strings.ToUpper(decodeID3Text(data[0], desc))+"="+decodeID3Text(data[0], value))
+		case id == "COMM" && len(data) > 4:
+			desc, value := splitID3Text(data[0], data[4:])
+			if len(desc) == 0 {
+				comments = append(comments, "COMMENT="+decodeID3Text(data[0], value))
+			}
+		case id == "WOAS":
+			comments = append(comments, "URL="+decodeID3Text(0, data))
+		case names[id] != "":
+			// Version 2.4 separates several values with NULs.
+			for _, v := range strings.Split(decodeID3Text(data[0], data[1:]), "\x00") {
+				// Each UTF-16 value has a byte order mark of its own.
+				v = strings.TrimPrefix(v, "\ufeff")
+				if v != "" {
+					comments = append(comments, names[id]+"="+v)
+				}
+			}
+		}
+	}
+	return comments, nil
+}
+
+// unsynchronize undoes ID3 unsynchronization, which follows each 0xff
+// with a 0x00 to keep the tag from looking like audio.
+func unsynchronize(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// splitID3Text splits b at the first string terminator of the encoding.
+func splitID3Text(enc byte, b []byte) (first, rest []byte) {
+	if enc == 1 || enc == 2 {
+		// UTF-16 strings end with two NULs, on a character boundary.
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// decodeID3Text decodes b, in the ID3 text encoding enc, dropping trailing
+// NULs.
+func decodeID3Text(enc byte, b []byte) string {
+	switch enc {
+	case 0:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return strings.TrimRight(string(r), "\x00")
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if b[0] == 0xff && b[1] == 0xfe || b[0] == 0xfe && b[1] == 0xff {
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
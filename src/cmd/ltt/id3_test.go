@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// id3v23Frame returns an ID3v2.3 frame, whose size is a plain 32-bit
+// integer.
+func id3v23Frame(id string, data []byte) []byte {
+	b := append([]byte(id), 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[4:], uint32(len(data)))
+	return append(b, data...)
+}
+
+// synchronize applies ID3 unsynchronisation to b, as taggers do, following
+// each 0xff that could be mistaken for an MPEG sync with a 0x00.
+func synchronize(b []byte) []byte {
+	var out []byte
+	for i, c := range b {
+		out = append(out, c)
+		if c == 0xff && (i+1 == len(b) || b[i+1] == 0 || b[i+1] >= 0xe0) {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+func TestReadID3v23Unsynchronized(t *testing.T) {
+	var frames []byte
+	// UTF-16 with a little-endian byte order mark, 0xff 0xfe, which must
+	// be unsynchronised.
+	frames = append(frames, id3v23Frame("TPE1", []byte{1, 0xff, 0xfe, 'B', 0, 'j', 0, 0xf6, 0, 'r', 0, 'k', 0})...)
+	// ISO-8859-1, with a ÿ followed by a byte an MPEG sync starts with.
+	frames = append(frames, id3v23Frame("TIT2", []byte{0, 'J', 0xff, 0xe9, 's'})...)
+	frames = append(frames, id3v23Frame("TCON", []byte("\x00Electronic"))...)
+	frames = append(frames, id3v23Frame("TYER", []byte("\x001997"))...)
+	frames = append(frames, id3v23Frame("COMM", []byte("\x00eng\x00https://reddit.com/r/listentothis/comments/abc/x/"))...)
+	frames = append(frames, id3v23Frame("TXXX", []byte("\x00Source\x00reddit"))...)
+	frames = append(frames, id3v23Frame("WOAS", []byte("https://www.youtube.com/watch?v=dQw4w9WgXcQ"))...)
+	frames = append(frames, id3v23Frame("APIC", []byte("\x00image/jpeg\x00\x03\x00\xff\xd8\xff\xe0"))...)
+
+	// An extended header: its size, not counting itself, then flags and
+	// the size of the padding.
+	body := []byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 16}
+	body = append(body, frames...)
+	body = append(body, make([]byte, 16)...)
+	body = synchronize(body)
+
+	tag := append([]byte{'I', 'D', '3', 3, 0, 0x80 | 0x40}, putSyncsafe(len(body))...)
+	tag = append(tag, body...)
+	path := filepath.Join(t.TempDir(), "song.mp3")
+	err := ioutil.WriteFile(path, append(tag, 0xff, 0xfb, 0x90, 0x00), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := readID3Tags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ARTIST=Björk",
+		"TITLE=Jÿés",
+		"GENRE=Electronic",
+		"DATE=1997",
+		"COMMENT=https://reddit.com/r/listentothis/comments/abc/x/",
+		"SOURCE=reddit",
+		"URL=https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+	}
+	if !reflect.DeepEqual(comments, want) {
+		t.Errorf("comments\n%q, want\n%q", comments, want)
+	}
+}
+
+func TestWriteID3TagsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "song.mp3")
+	audio := []byte{0xff, 0xfb, 0x90, 0x00, 1, 2, 3}
+	// An old tag, with a footer, to be replaced.
+	old := append([]byte{'I', 'D', '3', 4, 0, 0x10}, putSyncsafe(4)...)
+	old = append(old, 0, 0, 0, 0)
+	old = append(old, '3', 'D', 'I', 4, 0, 0x10, 0, 0, 0, 4)
+	err := ioutil.WriteFile(path, append(old, audio...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := &Tags{Cover: &Picture{MIME: "image/jpeg", Data: []byte{0xff, 0xd8}}}
+	tags.Add("ARTIST", "Artist")
+	tags.Add("GENRE", "Jazz")
+	tags.Add("GENRE", "Soul")
+	tags.Add("COMMENT", "https://reddit.com/r/listentothis/comments/abc/x/")
+	tags.Add("REPLAYGAIN_TRACK_GAIN", "-3.20 dB")
+	err = writeID3Tags(path, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := readID3Tags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ARTIST=Artist",
+		"GENRE=Jazz",
+		"GENRE=Soul",
+		"COMMENT=https://reddit.com/r/listentothis/comments/abc/x/",
+		"REPLAYGAIN_TRACK_GAIN=-3.20 dB",
+	}
+	if !reflect.DeepEqual(comments, want) {
+		t.Errorf("comments\n%q, want\n%q", comments, want)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, audio) || bytes.Count(b, []byte("ID3")) != 1 {
+		t.Errorf("old tag not replaced, or audio changed")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"audio"
+
+	"github.com/SlyMarbo/rss"
+)
+
+// importer matches audio files found on disk with the history, and records
+// those it can identify.
+type importer struct {
+	lib    *Library
+	dryRun bool
+
+	// The history, indexed by every file path, file hash, post ID and
+	// media ID it records.
+	paths   map[string]bool
+	byHash  map[string]*Download
+	byID    map[string]*Download
+	byMedia map[string]*Download
+
+	imported, linked, known, duplicates int
+
+	// orphans are the files that could not be identified.
+	orphans []string
+}
+
+func newImporter(lib *Library, dryRun bool) (*importer, error) {
+	im := &importer{
+		lib:     lib,
+		dryRun:  dryRun,
+		paths:   map[string]bool{},
+		byHash:  map[string]*Download{},
+		byID:    map[string]*Download{},
+		byMedia: map[string]*Download{},
+	}
+	dls, err := lib.Downloads()
+	if err != nil {
+		return nil, err
+	}
+	for _, dl := range dls {
+		im.add(dl)
+	}
+	return im, nil
+}
+
+// add indexes dl.
+func (im *importer) add(dl *Download) {
+	im.byID[dl.ID] = dl
+	for _, f := range dl.allFiles() {
+		im.paths[f.Path] = true
+	}
+	for _, f := range dl.Files {
+		if f.SHA256 != "" {
+			im.byHash[f.SHA256] = dl
+		}
+	}
+	if dl.MediaID == "" || dl.CurrentState() == StateLinked {
+		return
+	}
+	// Prefer the download that is done to posts that failed.
+	if prev := im.byMedia[dl.MediaID]; prev == nil || prev.CurrentState() != StateDone {
+		im.byMedia[dl.MediaID] = dl
+	}
+}
+
+// importInfo is what a file says about where it came from.
+type importInfo struct {
+	// URL is the media the file was downloaded from.
+	URL string
+
+	// Link is the reddit post, if ltt tagged the file with it.
+	Link   string
+	PostID string
+
+	Title string
+	Track Track
+}
+
+// ytdlInfo is the part of youtube-dl's --write-info-json output ltt uses.
+type ytdlInfo struct {
+	WebpageURL  string `json:"webpage_url"`
+	Title       string `json:"title"`
+	Track       string `json:"track"`
+	Artist      string `json:"artist"`
+	Creator     string `json:"creator"`
+	Genre       string `json:"genre"`
+	ReleaseYear int    `json:"release_year"`
+}
+
+// ytdlName matches the file names youtube-dl gives by default, which end
+// with the YouTube video ID.
+var ytdlName = regexp.MustCompile(`-([A-Za-z0-9_-]{11})$`)
+
+// identify gathers what the file at path says about itself: from its tags,
+// which ltt writes, then the info JSON youtube-dl writes next to it, then
+// its name.
+func identify(path string) *importInfo {
+	info := &importInfo{}
+	tags, err := readTags(path)
+	if err != nil {
+		log.Printf("failed to read tags of %q: %v", path, err)
+		tags = &Tags{}
+	}
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	var yi ytdlInfo
+	if data, err := ioutil.ReadFile(stem + ".info.json"); err == nil {
+		err = json.Unmarshal(data, &yi)
+		if err != nil {
+			log.Printf("failed to read %q: %v", stem+".info.json", err)
+		}
+	}
+
+	info.URL = tags.Get("URL")
+	if info.URL == "" {
+		info.URL = yi.WebpageURL
+	}
+	if info.URL == "" {
+		if m := ytdlName.FindStringSubmatch(filepath.Base(stem)); m != nil {
+			info.URL = "https://www.youtube.com/watch?v=" + m[1]
+		}
+	}
+	if id := redditPostID(tags.Get("COMMENT")); id != "" {
+		info.Link, info.PostID = tags.Get("COMMENT"), id
+	}
+
+	t := &info.Track
+	t.Artist, t.Title, t.Genres = tags.Get("ARTIST"), tags.Get("TITLE"), tags.Values("GENRE")
+	t.Year, _ = strconv.Atoi(tags.Get("DATE"))
+	if t.Artist == "" && t.Title == "" {
+		t.Artist, t.Title = yi.Artist, yi.Track
+		if t.Artist == "" {
+			t.Artist = yi.Creator
+		}
+		if yi.Genre != "" {
+			t.Genres = []string{yi.Genre}
+		}
+		t.Year = yi.ReleaseYear
+	}
+	info.Title = yi.Title
+	if info.Title == "" {
+		info.Title = t.String()
+	}
+	if t.Artist == "" && t.Title == "" {
+		if info.Title == "" {
+			info.Title = strings.TrimSpace(ytdlName.ReplaceAllString(filepath.Base(stem), ""))
+		}
+		*t = ParseTitle(info.Title)
+	}
+	return info
+}
+
+// redditPostID returns the ID of the reddit post at link, such as
+// "t3_abc123", or the empty string if link is not a reddit post.
+func redditPostID(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || !strings.HasSuffix(u.Hostname(), "reddit.com") {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "r" || parts[2] != "comments" {
+		return ""
+	}
+	return "t3_" + parts[3]
+}
+
+// importFile records the audio file at path: with the download it was
+// made by, if the history has one, or as a download of its own.
+func (im *importer) importFile(path string) error {
+	l := im.lib
+	rel, err := l.relPath(path)
+	if err != nil {
+		return err
+	}
+	if im.paths[rel] {
+		im.known++
+		return nil
+	}
+	f, err := l.describeFile(path)
+	if err != nil {
+		return err
+	}
+	im.paths[rel] = true
+
+	if dl := im.byHash[f.SHA256]; dl != nil {
+		return im.link(dl, f, "hash")
+	}
+	info := identify(path)
+	if dl := im.byID[info.PostID]; dl != nil && info.PostID != "" {
+		if orig := im.byID[dl.Original]; dl.CurrentState() == StateLinked && orig != nil {
+			dl = orig
+		}
+		return im.link(dl, f, "post")
+	}
+	var u *url.URL
+	var media *Media
+	if info.URL != "" {
+		u, err = url.Parse(info.URL)
+		if err == nil {
+			media, err = Resolve(u)
+		}
+		if err != nil {
+			log.Printf("cannot identify %q from %q: %v", rel, info.URL, err)
+		}
+	}
+	if media == nil {
+		im.orphans = append(im.orphans, rel)
+		return nil
+	}
+	if dl := im.byMedia[media.ID]; dl != nil {
+		return im.link(dl, f, "media")
+	}
+
+	link := info.Link
+	if link == "" {
+		link = media.URL.String()
+	}
+	// The post date is lost, but the file was downloaded soon after.
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dl, err := NewDownload(rss.Item{Title: info.Title, Link: link, Date: stat.ModTime()}, u)
+	if err != nil {
+		return err
+	}
+	// As with songs added by hand, files with no post are recorded by
+	// media.
+	dl.ID = info.PostID
+	if dl.ID == "" {
+		dl.ID = dl.MediaID
+	}
+	dl.Track = info.Track
+	dl.Files = []File{*f}
+	written := stat.ModTime()
+	dl.Downloaded = &written
+	im.findCover(dl, path)
+	im.imported++
+	im.add(dl)
+	if im.dryRun {
+		log.Printf("would import %q as %q", rel, dl.ID)
+		return nil
+	}
+	log.Printf("imported %q as %q", rel, dl.ID)
+	return l.transition(dl, StateDone, nil)
+}
+
+// link records f as a file of dl, which was matched by how. A file that
+// was recorded elsewhere and is no longer there has moved; otherwise f is
+// added to the files.
+func (im *importer) link(dl *Download, f *File, how string) error {
+	l := im.lib
+	moved := false
+	for i := range dl.Files {
+		old := &dl.Files[i]
+		if old.SHA256 != f.SHA256 {
+			continue
+		}
+		if _, err := os.Stat(l.absPath(old)); err == nil {
+			log.Printf("%q is a copy of %q, leaving it out", f.Path, old.Path)
+			im.duplicates++
+			return nil
+		}
+		// What the file was made as and measured at still holds.
+		f.Profile, f.Loudness = old.Profile, old.Loudness
+		*old, moved = *f, true
+		break
+	}
+	if !moved {
+		dl.Files = append(dl.Files, *f)
+	}
+	// An evicted song that is back is no longer evicted.
+	dl.Evicted = nil
+	if dl.Downloaded == nil {
+		if info, err := os.Stat(l.absPath(f)); err == nil {
+			written := info.ModTime()
+			dl.Downloaded = &written
+		}
+	}
+	im.findCover(dl, l.absPath(f))
+	im.linked++
+	im.add(dl)
+	if im.dryRun {
+		log.Printf("would link %q to %q by %s", f.Path, dl.ID, how)
+		return nil
+	}
+	log.Printf("linked %q to %q by %s", f.Path, dl.ID, how)
+	if dl.CurrentState() != StateDone {
+		// The song is here after all.
+		return l.transition(dl, StateDone, nil)
+	}
+	return l.SaveFiles(dl)
+}
+
+// findCover records the cover saved next to the song at path, as saveCover
+// names it, if dl has none on disk.
+func (im *importer) findCover(dl *Download, path string) {
+	if dl.Cover != nil {
+		if _, err := os.Stat(im.lib.absPath(dl.Cover)); err == nil {
+			return
+		}
+	}
+	cover := strings.TrimSuffix(path, filepath.Ext(path)) + ".jpg"
+	if _, err := os.Stat(cover); err != nil {
+		return
+	}
+	if f, err := im.lib.describeFile(cover); err == nil {
+		dl.Cover = f
+		im.paths[f.Path] = true
+	}
+}
+
+// missing returns the downloads that are done but have no files on disk.
+func (im *importer) missing() []*Download {
+	var dls []*Download
+	for _, dl := range im.byID {
+		if dl.CurrentState() == StateDone && dl.Evicted == nil && im.lib.FindFile(dl) == nil {
+			dls = append(dls, dl)
+		}
+	}
+	sort.Slice(dls, func(i, j int) bool { return dls[i].Date.Before(dls[j].Date) })
+	return dls
+}
+
+func runImport(cfg *Config, args []string) error {
+	fs := newFlagSet("import")
+	dryRun := fs.Bool("dry-run", false, "print what would be recorded without recording it")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	dir := lib.Path
+	if fs.NArg() == 1 {
+		// Paths are only relative to the library if both are absolute, or
+		// both relative.
+		dir = filepath.Clean(fs.Arg(0))
+		if filepath.IsAbs(lib.Path) {
+			dir, err = filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := lib.relPath(dir); err != nil {
+		return fmt.Errorf("%q is not in the library %q; move it there to import it", dir, lib.Path)
+	}
+
+	im, err := newImporter(lib, *dryRun)
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip the history, and anything else hidden.
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !audio.IsFile(filepath.ToSlash(path)) {
+			return nil
+		}
+		if err := im.importFile(path); err != nil {
+			log.Printf("failed to import %q: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return im.report()
+}
+
+// report prints the orphans in both directions, files with no download and
+// downloads with no files, and sums up.
+func (im *importer) report() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if len(im.orphans) > 0 {
+		fmt.Fprintln(w, "Files with no record:")
+		for _, path := range im.orphans {
+			fmt.Fprintf(w, "  %s\n", path)
+		}
+		fmt.Fprintln(w)
+	}
+	missing := im.missing()
+	if len(missing) > 0 {
+		fmt.Fprintln(w, "Records with no files:")
+		for _, dl := range missing {
+			fmt.Fprintf(w, "  %s\t%s\n", dl.ID, dl.Track)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d imported, %d linked, %d already recorded, %d copies, %d files with no record, %d records with no files\n",
+		im.imported, im.linked, im.known, im.duplicates, len(im.orphans), len(missing))
+	return w.Flush()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var downloadedBucket = []byte("downloaded")
+
+// lockTimeout is how long opening the history waits for another ltt, which
+// holds it locked while it runs, before giving up.
+const lockTimeout = 5 * time.Second
+
+type Library struct {
+	*bolt.DB
+
+	Path string
+
+	// Downloaders are tried in order until one succeeds.
+	Downloaders []Downloader
+
+	// Retry decides when failed downloads are retried.
+	Retry RetryPolicy
+
+	// Outputs are the profiles each download is made into. If there are
+	// none, the downloaded files are kept as they are.
+	Outputs []*Profile
+
+	// CoverArt embeds cover art in downloaded files, and saves it next to
+	// them.
+	CoverArt bool
+
+	// ReplayGain measures the loudness of downloaded files, and tags them
+	// with it.
+	ReplayGain bool
+
+	// Retention limits the songs outside Keep/.
+	Retention RetentionPolicy
+
+	// Namer names downloaded files. If it is nil, files keep the names
+	// their downloader gave them.
+	Namer *Namer
+
+	// media indexes a read-only history from before the media index was
+	// kept, by media ID, as it cannot be written to.
+	media map[string]string
+
+	// scratch is the directory of a stand-in history, removed on Close.
+	scratch string
+
+	// stop, when closed, means ltt is stopping, and download failures are
+	// taken for interruptions.
+	stop <-chan struct{}
+
+	// claims are the paths picked for files that are not recorded yet, by
+	// the ID of the download they are for, so that downloads running at
+	// once never pick the same one.
+	claimsMu sync.Mutex
+	claims   map[string]string
+}
+
+func NewLibrary(path string) (*Library, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openHistory(path, filepath.Join(path, ".history"), false)
+	if err != nil {
+		return nil, err
+	}
+	return newLibrary(db, path), nil
+}
+
+// NewReadOnlyLibrary opens the library at path for reading only. Other
+// readers can open it at the same time, and nothing is written, not even
+// to create the library: if it has no history yet, it has an empty one
+// that is thrown away on Close.
+func NewReadOnlyLibrary(path string) (*Library, error) {
+	dbpath := filepath.Join(path, ".history")
+	if _, err := os.Stat(dbpath); !os.IsNotExist(err) {
+		db, err := openHistory(path, dbpath, true)
+		if err != nil {
+			return nil, err
+		}
+		return newLibrary(db, path), nil
+	}
+	scratch, err := ioutil.TempDir("", "ltt")
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(scratch, ".history"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(scratch)
+		return nil, err
+	}
+	lib := newLibrary(db, path)
+	lib.scratch = scratch
+	return lib, nil
+}
+
+// openHistory opens the history of the library at path, waiting for
+// another ltt to let go of it for up to lockTimeout.
+func openHistory(path, dbpath string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("library %q is in use by another ltt (daemon?)", path)
+	}
+	return db, err
+}
+
+func newLibrary(db *bolt.DB, path string) *Library {
+	return &Library{
+		DB:   db,
+		Path: path,
+		Downloaders: []Downloader{
+			&ytdlDownloader{command: "youtube-dl", format: "vorbis"},
+		},
+		Retry: defaultRetryPolicy(),
+	}
+}
+
+// Close closes the history, and removes it if it was a stand-in for a
+// library with none.
+func (l *Library) Close() error {
+	err := l.DB.Close()
+	if l.scratch != "" {
+		os.RemoveAll(l.scratch)
+	}
+	return err
+}
+
+// openLibrary opens the library configured by cfg.
+func openLibrary(cfg *Config) (*Library, error) {
+	lib, err := NewLibrary(cfg.Library)
+	if err != nil {
+		return nil, err
+	}
+	err = lib.indexHistory()
+	if err == nil {
+		err = lib.recoverInterrupted()
+	}
+	if err == nil {
+		err = lib.configure(cfg)
+	}
+	if err != nil {
+		lib.Close()
+		return nil, err
+	}
+	return lib, nil
+}
+
+// openReadOnlyLibrary opens the library configured by cfg for commands
+// that only read the history, so that they can run alongside each other.
+func openReadOnlyLibrary(cfg *Config) (*Library, error) {
+	lib, err := NewReadOnlyLibrary(cfg.Library)
+	if err != nil {
+		return nil, err
+	}
+	err = lib.indexHistoryInMemory()
+	if err == nil {
+		err = lib.configure(cfg)
+	}
+	if err != nil {
+		lib.Close()
+		return nil, err
+	}
+	return lib, nil
+}
+
+// configure sets up l as cfg says.
+func (l *Library) configure(cfg *Config) error {
+	var err error
+	l.Retry = cfg.Retry
+	l.Retention = cfg.Retention
+	l.CoverArt = cfg.CoverArt
+	l.ReplayGain = cfg.ReplayGain
+	l.Outputs, err = cfg.outputProfiles()
+	if err != nil {
+		return err
+	}
+	if cfg.Naming != "" {
+		l.Namer, err = NewNamer(cfg.Naming)
+		if err != nil {
+			return err
+		}
+	}
+	if len(cfg.Downloaders) > 0 {
+		l.Downloaders = nil
+	}
+	for _, name := range cfg.Downloaders {
+		d, err := NewDownloader(name, cfg.AudioFormat)
+		if err != nil {
+			return err
+		}
+		l.Downloaders = append(l.Downloaders, d)
+	}
+	return nil
+}
+
+// Archive downloads dl and records it in the history. Each step is
+// recorded in a transaction of its own, so that other downloads can be
+// recorded while this one runs. If dl is already done, Archive fails with
+// ErrAlreadyDownloaded before downloading anything.
+func (l *Library) Archive(dl *Download) error {
+	err := l.transition(dl, StateDownloading, nil)
+	if err != nil {
+		return err
+	}
+	// Once recorded, or removed, the files no longer need claiming.
+	defer l.unclaim(dl)
+
+	dir := filepath.Join(l.Path, dl.Folder)
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = l.download(dl, dir)
+	}
+	if err != nil && l.stopping() {
+		// Most likely killed on the way out, which is no fault of the
+		// download's.
+		log.Printf("%q was interrupted: %v", dl.ID, err)
+		if ierr := l.interrupt(dl); ierr != nil {
+			log.Printf("failed to record interruption of %q: %v", dl.ID, ierr)
+		}
+		return errInterrupted
+	}
+	if err != nil {
+		if terr := l.transition(dl, StateFailed, err); terr != nil {
+			log.Printf("failed to record failure of %q: %v", dl.ID, terr)
+		}
+		return err
+	}
+	return l.transition(dl, StateDone, nil)
+}
+
+func (l *Library) stopping() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Downloaded returns whether the history has id done.
+func (l *Library) Downloaded(id string) (bool, error) {
+	dl, err := l.Record(id)
+	if err != nil {
+		return false, err
+	}
+	return dl != nil && dl.CurrentState() == StateDone, nil
+}
+
+// Downloads returns all downloads recorded in the history, in key order.
+func (l *Library) Downloads() ([]*Download, error) {
+	var dls []*Download
+	err := l.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			dl, err := decodeDownload(k, v)
+			if err != nil {
+				return err
+			}
+			dls = append(dls, dl)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dls, nil
+}
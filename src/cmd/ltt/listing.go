@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SlyMarbo/rss"
+)
+
+// userAgent identifies ltt to reddit, which throttles generic clients.
+const userAgent = "ltt/0.1 (+https://github.com/cmars/ltt)"
+
+// Listing is a page of posts from one of reddit's JSON listing endpoints.
+type Listing struct {
+	// After is the cursor for the next page, or empty on the last page.
+	After string
+
+	Posts []*Post
+}
+
+// Post is a reddit link post, as returned in a listing.
+type Post struct {
+	Name       string  `json:"name"`
+	Title      string  `json:"title"`
+	URL        string  `json:"url"`
+	Permalink  string  `json:"permalink"`
+	Domain     string  `json:"domain"`
+	Subreddit  string  `json:"subreddit"`
+	IsSelf     bool    `json:"is_self"`
+	CreatedUTC float64 `json:"created_utc"`
+}
+
+// Created returns the time the post was submitted.
+func (p *Post) Created() time.Time {
+	return time.Unix(int64(p.CreatedUTC), 0)
+}
+
+// ListingURL returns the URL of the JSON listing of sub sorted by sort,
+// starting after the given cursor. Top listings cover all time.
+func ListingURL(sub *Subscription, sort, after string) string {
+	q := url.Values{}
+	q.Set("limit", "100")
+	q.Set("raw_json", "1")
+	if sort == "top" {
+		q.Set("t", "all")
+	}
+	if after != "" {
+		q.Set("after", after)
+	}
+	return "https://www.reddit.com/" + strings.Trim(sub.Path, "/") + "/" + sort + ".json?" + q.Encode()
+}
+
+// FetchListing fetches a page of a JSON listing.
+func FetchListing(client *http.Client, u string) (*Listing, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %q: %s", u, resp.Status)
+	}
+
+	var doc struct {
+		Data struct {
+			After    string `json:"after"`
+			Children []struct {
+				Kind string `json:"kind"`
+				Data *Post  `json:"data"`
+			} `json:"children"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode listing %q: %v", u, err)
+	}
+	l := &Listing{After: doc.Data.After}
+	for _, child := range doc.Data.Children {
+		if child.Kind == "t3" && child.Data != nil {
+			l.Posts = append(l.Posts, child.Data)
+		}
+	}
+	return l, nil
+}
+
+// ParsePost returns a Download for a listing post. The download has the
+// same ID the post has in reddit's feeds, so that history is shared between
+// the two sources.
+func ParsePost(p *Post) (*Download, error) {
+	if p.IsSelf {
+		return nil, fmt.Errorf("self post has no download link")
+	}
+	u, err := url.Parse(html.UnescapeString(p.URL))
+	if err != nil {
+		return nil, err
+	}
+	return NewDownload(rss.Item{
+		ID:    p.Name,
+		Title: html.UnescapeString(p.Title),
+		Link:  "https://www.reddit.com" + p.Permalink,
+		Date:  p.Created(),
+	}, u)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Loudness is the loudness of a file, as measured by EBU R128.
+type Loudness struct {
+	// Integrated is the loudness of the whole file, in LUFS.
+	Integrated float64
+
+	// Peak is the true peak, in dBTP.
+	Peak float64
+}
+
+// Reference loudness levels, in LUFS.
+const (
+	replayGainReference = -18
+	r128Reference       = -23
+)
+
+var (
+	integratedRE = regexp.MustCompile(`(?m)^\s*I:\s*(-?[0-9.]+|-inf) LUFS`)
+	peakRE       = regexp.MustCompile(`(?m)^\s*Peak:\s*(-?[0-9.]+|-inf) dBFS`)
+)
+
+// analyzeLoudness measures the loudness of the audio file at path with
+// ffmpeg's ebur128 filter.
+func analyzeLoudness(path string) (*Loudness, error) {
+	var stderr bytes.Buffer
+	cmd := childCommand("ffmpeg", "-nostdin", "-hide_banner", "-nostats",
+		"-i", path, "-map", "0:a:0", "-filter:a", "ebur128=peak=true", "-f", "null", "-")
+	cmd.Stderr = &stderr
+	err := runChild(cmd)
+	if err != nil {
+		if msg := lastLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("ffmpeg: %v", err)
+	}
+
+	// The filter logs as it goes, then sums up.
+	out := stderr.String()
+	if i := strings.LastIndex(out, "Summary:"); i >= 0 {
+		out = out[i:]
+	}
+	i := integratedRE.FindStringSubmatch(out)
+	p := peakRE.FindStringSubmatch(out)
+	if i == nil || p == nil {
+		return nil, fmt.Errorf("no loudness summary from ffmpeg")
+	}
+	l := &Loudness{}
+	l.Integrated, err = parseLevel(i[1])
+	if err == nil {
+		l.Peak, err = parseLevel(p[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if math.IsInf(l.Integrated, -1) {
+		return nil, fmt.Errorf("%q is silent", path)
+	}
+	return l, nil
+}
+
+func parseLevel(s string) (float64, error) {
+	if s == "-inf" {
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// addTags adds the tags players use to level the file at path: R128 gain
+// for Opus files, whose players apply it relative to -23 LUFS, and
+// ReplayGain 2.0 for everything else.
+func (l *Loudness) addTags(t *Tags, path string) {
+	if strings.ToLower(filepath.Ext(path)) == ".opus" {
+		// A Q7.8 fixed point number of dB.
+		gain := math.Round((r128Reference - l.Integrated) * 256)
+		gain = math.Max(math.Min(gain, math.MaxInt16), math.MinInt16)
+		t.Add("R128_TRACK_GAIN", strconv.Itoa(int(gain)))
+		return
+	}
+	t.Add("REPLAYGAIN_TRACK_GAIN", fmt.Sprintf("%.2f dB", replayGainReference-l.Integrated))
+	t.Add("REPLAYGAIN_TRACK_PEAK", fmt.Sprintf("%.6f", math.Pow(10, l.Peak/20)))
+	t.Add("REPLAYGAIN_REFERENCE_LOUDNESS", fmt.Sprintf("%d LUFS", replayGainReference))
+}
@@ -2,29 +2,80 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/SlyMarbo/rss"
-	"github.com/boltdb/bolt"
 )
 
 type Download struct {
 	rss.Item
 
 	URL url.URL
-}
 
-type Library struct {
-	*bolt.DB
+	// MediaID identifies the linked media regardless of which URL was
+	// posted, such as "youtube:dQw4w9WgXcQ".
+	MediaID string `json:",omitempty"`
+
+	// Backend is the kind of downloader the media needs.
+	Backend string `json:",omitempty"`
+
+	// Files are the files the download wrote.
+	Files []File `json:",omitempty"`
+
+	// Cover is the cover art saved next to the first file, if any.
+	Cover *File `json:",omitempty"`
+
+	// Downloader and DownloaderVersion record what downloaded the media.
+	Downloader        string `json:",omitempty"`
+	DownloaderVersion string `json:",omitempty"`
+
+	// Track is the song metadata parsed from the post title.
+	Track Track
+
+	// State is where the download is in its lifecycle.
+	State State `json:",omitempty"`
+
+	// Updated is when State last changed.
+	Updated time.Time
 
-	Path string
+	// Error is why the download failed or was skipped.
+	Error string `json:",omitempty"`
+
+	// Original is the ID of the post the media was downloaded from, if
+	// this is a repost of it.
+	Original string `json:",omitempty"`
+
+	// Feed is the name of the subscription the download came from.
+	Feed string `json:",omitempty"`
+
+	// Folder is the directory, relative to the library, the download is
+	// saved in.
+	Folder string `json:",omitempty"`
+
+	// Downloaded is when the files were downloaded, or for songs that were
+	// imported, written.
+	Downloaded *time.Time `json:",omitempty"`
+
+	// Evicted is when the files of the download were deleted to keep the
+	// library within its retention policy. The download stays done, so
+	// that it is not downloaded again.
+	Evicted *time.Time `json:",omitempty"`
+}
+
+// downloadedAt returns when dl was downloaded. Records from before ltt kept
+// track have only when they last changed.
+func (dl *Download) downloadedAt() time.Time {
+	if dl.Downloaded != nil {
+		return *dl.Downloaded
+	}
+	return dl.Updated
 }
 
 func defaultPath() string {
@@ -35,92 +86,97 @@ func defaultPath() string {
 	return filepath.Join(home, "Music", "listentothis")
 }
 
-func main() {
-	path := "r/listentothis"
-	if len(os.Args) > 1 {
-		path = os.Args[1]
-	}
-	query := ""
-	if len(os.Args) > 2 {
-		query = os.Args[2]
-	}
-	feed, err := rss.Fetch("https://www.reddit.com/" + path + "/.rss" + query)
-	if err != nil {
-		log.Fatal(err)
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(cfg *Config, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	// Populated here rather than in the declaration because the commands
+	// refer back to the table for their usage text.
+	commands = []*command{
+		{"fetch", "[flags]", "fetch feeds and download new songs", runFetch},
+		{"daemon", "[flags]", "keep polling feeds and downloading new songs", runDaemon},
+		{"backfill", "[flags]", "download older posts from reddit's listings", runBackfill},
+		{"add", "[flags] url", "download a single song by URL", runAdd},
+		{"list", "[flags]", "list downloaded songs", runList},
+		{"show", "[flags] id", "show everything recorded about a download", runShow},
+		{"search", "[flags] text", "search downloads by title, artist, genre or URL", runSearch},
+		{"failures", "[flags]", "list failed downloads awaiting retry", runFailures},
+		{"retry", "[flags] [id...]", "retry failed downloads now", runRetry},
+		{"import", "[flags] [dir]", "record songs already in the library in the history", runImport},
+		{"evict", "[flags]", "delete songs over the retention policy now", runEvict},
+		{"fsck", "[flags]", "check the history against the files on disk", runFsck},
+		{"export", "[flags]", "export the history as CSV, JSON Lines, M3U or XSPF", runExport},
+		{"relayout", "[flags]", "move downloaded songs to match the naming template", runRelayout},
+		{"config", "", "print the effective configuration", runConfig},
 	}
+}
 
-	var available []*Download
-	for _, item := range feed.Items {
-		download, err := ParseDownload(item)
-		if err != nil {
-			log.Printf("don't know how to download %q: %v", item.ID, err)
-		} else {
-			available = append(available, download)
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
 		}
 	}
+	return nil
+}
 
-	lib, err := NewLibrary(defaultPath())
-	if err != nil {
-		log.Fatal(err)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <command> [command flags]\n\nflags:\n", filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
 	}
-	defer lib.Close()
+	fmt.Fprintf(os.Stderr, "\nWith no command, %s runs fetch.\n", filepath.Base(os.Args[0]))
+}
 
-	for _, dl := range available {
-		err := lib.Archive(dl)
-		if err != nil {
-			log.Printf("failed to archive %q: %v", dl.ID, err)
-		} else {
-			log.Printf("downloaded %q", dl.ID)
-		}
+// newFlagSet returns a flag set for cmd with usage output matching the
+// top-level usage.
+func newFlagSet(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		c := findCommand(cmd)
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n\n%s\n", filepath.Base(os.Args[0]), c.name, c.args, c.summary)
+		fs.PrintDefaults()
 	}
+	return fs
 }
 
-func NewLibrary(path string) (*Library, error) {
-	err := os.MkdirAll(path, 0755)
+func main() {
+	configPath := flag.String("config", defaultConfigPath(), "path to the config file")
+	library := flag.String("library", "", "library directory (overrides config)")
+	flag.Usage = usage
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
+	}
+	if *library != "" {
+		cfg.Library = *library
 	}
 
-	dbpath := filepath.Join(path, ".history")
-	db, err := bolt.Open(dbpath, 0600, nil)
+	name, args := "fetch", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	catchSignals()
+	err = cmd.run(cfg, args)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	return &Library{
-		DB:   db,
-		Path: path,
-	}, nil
-}
-
-func (l *Library) Archive(dl *Download) error {
-	return l.Update(func(tx *bolt.Tx) error {
-		cmd := exec.Command("youtube-dl", "-x", "--audio-format", "vorbis", dl.URL.String())
-		cmd.Dir = l.Path
-		err := cmd.Run()
-		if err != nil {
-			return err
-		}
-
-		b, err := tx.CreateBucketIfNotExists([]byte("downloaded"))
-		if err != nil {
-			return err
-		}
-		if b.Get([]byte(dl.ID)) != nil {
-			return fmt.Errorf("already downloaded %q", dl.ID)
-		}
-
-		data, err := json.Marshal(dl)
-		if err != nil {
-			return err
-		}
-
-		err = b.Put([]byte(dl.ID), data)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	})
 }
 
 func ParseDownload(item *rss.Item) (*Download, error) {
@@ -140,16 +196,21 @@ func ParseDownload(item *rss.Item) (*Download, error) {
 	if err != nil {
 		return nil, err
 	}
-	if !isSupportedURL(u) {
-		return nil, fmt.Errorf("unsupported download URL: %q", u)
-	}
+	return NewDownload(*item, u)
+}
 
+// NewDownload returns a Download of the media at u, posted as item, or an
+// error if ltt does not know how to download it.
+func NewDownload(item rss.Item, u *url.URL) (*Download, error) {
+	media, err := Resolve(u)
+	if err != nil {
+		return nil, err
+	}
 	return &Download{
-		Item: *item,
-		URL:  *u,
+		Item:    item,
+		URL:     media.URL,
+		MediaID: media.ID,
+		Backend: media.Backend,
+		Track:   ParseTitle(item.Title),
 	}, nil
 }
-
-func isSupportedURL(u *url.URL) bool {
-	return true
-}
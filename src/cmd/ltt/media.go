@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// mediaBucket indexes the history by media ID, so that the same song
+// posted again, perhaps under a different URL, is recognized.
+var mediaBucket = []byte("media")
+
+var (
+	// ErrRepost is returned when queueing a post of media that has
+	// already been downloaded from another post.
+	ErrRepost = fmt.Errorf("repost of media already downloaded")
+
+	// ErrInProgress is returned when queueing a post of media that is
+	// being downloaded from another post.
+	ErrInProgress = fmt.Errorf("media is being downloaded from another post")
+)
+
+// resolveMediaID fills in the media ID of records from before media was
+// resolved.
+func (dl *Download) resolveMediaID() {
+	if dl.MediaID != "" {
+		return
+	}
+	u := dl.URL
+	if media, err := Resolve(&u); err == nil {
+		dl.MediaID = media.ID
+	}
+}
+
+func getRecord(b *bolt.Bucket, id string) (*Download, error) {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	return decodeDownload([]byte(id), v)
+}
+
+// decide makes the checks that queueing dl goes through, without writing
+// anything, so that a dry run sees what a fetch would do. It fails with
+// ErrAlreadyDownloaded if dl is done, ErrRepost if it is linked to another
+// post, ErrDead or ErrNotDue if it failed and is not due for a retry, or
+// ErrInProgress if its media is being downloaded from another post. If its
+// media was already downloaded from another post, that post is returned as
+// orig. prev is the record of dl, if there is one.
+func (l *Library) decide(tx *bolt.Tx, dl *Download) (prev, orig *Download, err error) {
+	b := tx.Bucket(downloadedBucket)
+	if b == nil {
+		return nil, nil, nil
+	}
+	prev, err = getRecord(b, dl.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev != nil {
+		switch prev.CurrentState() {
+		case StateDone:
+			return prev, nil, ErrAlreadyDownloaded
+		case StateLinked:
+			return prev, nil, ErrRepost
+		}
+		err = checkRetry(tx, prev)
+		if err != nil {
+			return prev, nil, err
+		}
+	}
+	orig, err = l.lookupMedia(tx, b, dl)
+	if err != nil || orig == nil {
+		return prev, nil, err
+	}
+	switch orig.CurrentState() {
+	case StateDone:
+		return prev, orig, nil
+	case StateQueued, StateDownloading:
+		return prev, nil, ErrInProgress
+	}
+	return prev, nil, nil
+}
+
+// lookupMedia returns the record of the other post, if any, that the media
+// of dl is indexed under.
+func (l *Library) lookupMedia(tx *bolt.Tx, b *bolt.Bucket, dl *Download) (*Download, error) {
+	id := l.mediaOwner(tx, dl.MediaID)
+	if id == "" || id == dl.ID {
+		return nil, nil
+	}
+	return getRecord(b, id)
+}
+
+// mediaOwner returns the ID of the post the media is indexed under, or the
+// empty string if there is none. A read-only history from before the index
+// was kept has it in memory instead.
+func (l *Library) mediaOwner(tx *bolt.Tx, mediaID string) string {
+	if mediaID == "" {
+		return ""
+	}
+	if idx := tx.Bucket(mediaBucket); idx != nil {
+		return string(idx.Get([]byte(mediaID)))
+	}
+	return l.media[mediaID]
+}
+
+// indexMedia points the media index at dl.
+func indexMedia(tx *bolt.Tx, dl *Download) error {
+	if dl.MediaID == "" {
+		return nil
+	}
+	idx, err := tx.CreateBucketIfNotExists(mediaBucket)
+	if err != nil {
+		return err
+	}
+	return idx.Put([]byte(dl.MediaID), []byte(dl.ID))
+}
+
+// ByMedia returns the done download of the given media, or nil if there is
+// none.
+func (l *Library) ByMedia(mediaID string) (*Download, error) {
+	var dl *Download
+	err := l.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(downloadedBucket)
+		id := l.mediaOwner(tx, mediaID)
+		if b == nil || id == "" {
+			return nil
+		}
+		var err error
+		dl, err = getRecord(b, id)
+		if dl != nil && dl.CurrentState() != StateDone {
+			dl = nil
+		}
+		return err
+	})
+	return dl, err
+}
+
+// indexHistory builds the media index from the history, if it has not been
+// built yet.
+func (l *Library) indexHistory() error {
+	indexed := false
+	err := l.View(func(tx *bolt.Tx) error {
+		indexed = tx.Bucket(mediaBucket) != nil
+		return nil
+	})
+	if err != nil || indexed {
+		return err
+	}
+	return l.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(mediaBucket) != nil {
+			return nil
+		}
+		idx, err := tx.CreateBucket(mediaBucket)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return nil
+		}
+		n := 0
+		err = forEachMedia(b, func(mediaID, id []byte) error {
+			n++
+			return idx.Put(mediaID, id)
+		})
+		if n > 0 {
+			log.Printf("indexed %d downloads by media", n)
+		}
+		return err
+	})
+}
+
+// indexHistoryInMemory builds the media index of a history opened
+// read-only that has none yet, in memory, so that reposts are still
+// recognized.
+func (l *Library) indexHistoryInMemory() error {
+	return l.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(mediaBucket) != nil {
+			return nil
+		}
+		l.media = map[string]string{}
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return nil
+		}
+		return forEachMedia(b, func(mediaID, id []byte) error {
+			l.media[string(mediaID)] = string(id)
+			return nil
+		})
+	})
+}
+
+// forEachMedia calls f with the media ID and ID of each done download in
+// b.
+func forEachMedia(b *bolt.Bucket, f func(mediaID, id []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		dl, err := decodeDownload(k, v)
+		if err != nil {
+			return err
+		}
+		if dl.MediaID == "" || dl.CurrentState() != StateDone {
+			return nil
+		}
+		return f([]byte(dl.MediaID), k)
+	})
+}
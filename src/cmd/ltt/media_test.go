@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/SlyMarbo/rss"
+)
+
+// testLibrary returns a library with an empty history in a temporary
+// directory.
+func testLibrary(t *testing.T) *Library {
+	lib, err := openLibrary(&Config{Library: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lib.Close() })
+	return lib
+}
+
+// testPost returns the download of a post with the given ID linking to
+// link.
+func testPost(t *testing.T, id, link string) *Download {
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl, err := NewDownload(rss.Item{Title: "Artist -- Song [Jazz]", Link: "https://www.reddit.com/r/listentothis/comments/" + id}, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.ID = "t3_" + id
+	return dl
+}
+
+func TestRepostLinksToOriginal(t *testing.T) {
+	lib := testLibrary(t)
+	orig := testPost(t, "a", "https://youtu.be/dQw4w9WgXcQ")
+	repost := testPost(t, "b", "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=10")
+
+	err := lib.Queue(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same media from another post waits for the first to finish.
+	if err := lib.Queue(repost); err != ErrInProgress {
+		t.Fatalf("queueing repost while the original is queued: %v, want ErrInProgress", err)
+	}
+	err = lib.transition(orig, StateDone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lib.Queue(repost); err != ErrRepost {
+		t.Fatalf("queueing repost: %v, want ErrRepost", err)
+	}
+	rec, err := lib.Record(repost.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.CurrentState() != StateLinked || rec.Original != orig.ID {
+		t.Fatalf("repost recorded as %+v, want linked to %q", rec, orig.ID)
+	}
+	// Seeing the repost again does not download it either.
+	if err := lib.Queue(testPost(t, "b", "https://youtu.be/dQw4w9WgXcQ")); err != ErrRepost {
+		t.Errorf("queueing repost again: %v, want ErrRepost", err)
+	}
+
+	got, err := lib.ByMedia("youtube:dQw4w9WgXcQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.ID != orig.ID {
+		t.Errorf("ByMedia returned %+v, want %q", got, orig.ID)
+	}
+}
+
+func TestAddedSongLinksToPost(t *testing.T) {
+	lib := testLibrary(t)
+	orig := testPost(t, "a", "https://www.youtube.com/watch?v=dQw4w9WgXcQ")
+	err := lib.Queue(orig)
+	if err == nil {
+		err = lib.transition(orig, StateDone, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As runAdd records songs added by hand.
+	added := testPost(t, "x", "https://youtu.be/dQw4w9WgXcQ")
+	added.ID = added.MediaID
+	if err := lib.Queue(added); err != ErrRepost || added.Original != orig.ID {
+		t.Errorf("queueing added song: %v, linked to %q; want ErrRepost, linked to %q", err, added.Original, orig.ID)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Namer names downloaded files after their post, with a text/template
+// such as "{{.Genre}}/{{.Artist}} - {{.Title}} ({{.Year}}).{{.Ext}}".
+// Slashes in the template make directories; slashes in the metadata do
+// not.
+type Namer struct {
+	tmpl *template.Template
+}
+
+// NewNamer parses a naming template. The template is executed with a
+// NameData.
+func NewNamer(text string) (*Namer, error) {
+	tmpl, err := template.New("naming").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid naming template %q: %v", text, err)
+	}
+	n := &Namer{tmpl: tmpl}
+	// Catch references to missing fields now rather than on the first
+	// download.
+	_, err = n.Name(&Download{}, "ogg")
+	if err != nil {
+		return nil, fmt.Errorf("invalid naming template %q: %v", text, err)
+	}
+	return n, nil
+}
+
+// NameData is what naming templates can refer to.
+type NameData struct {
+	// Artist, Title and Genre are never empty, so that a template does
+	// not produce names like " - .ogg".
+	Artist string
+	Title  string
+	Genre  string
+
+	Genres []string
+
+	// Year is empty if the post does not give one.
+	Year  string
+	Notes string
+
+	// Feed names the subscription the post came from.
+	Feed string
+
+	ID      string
+	MediaID string
+
+	// Date is the day of the post, as 2006-01-02.
+	Date string
+
+	// Ext is the extension of the downloaded file, without the dot.
+	Ext string
+}
+
+func newNameData(dl *Download, ext string) *NameData {
+	t := dl.Track
+	d := &NameData{
+		Artist:  nameField(t.Artist, "Unknown Artist"),
+		Title:   nameField(t.Title, nameField(dl.Title, "Untitled")),
+		Genre:   nameField(t.Genre(), "Unknown Genre"),
+		Notes:   nameField(t.Notes, ""),
+		Feed:    nameField(dl.Feed, ""),
+		ID:      nameField(dl.ID, ""),
+		MediaID: nameField(dl.MediaID, ""),
+		Ext:     nameField(ext, ""),
+	}
+	for _, g := range t.Genres {
+		d.Genres = append(d.Genres, nameField(g, ""))
+	}
+	if t.Year != 0 {
+		d.Year = strconv.Itoa(t.Year)
+	}
+	if !dl.Date.IsZero() {
+		d.Date = dl.Date.Format("2006-01-02")
+	}
+	return d
+}
+
+// nameField returns s, or def if it is blank, without slashes.
+func nameField(s, def string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def
+	}
+	return strings.NewReplacer("/", "-", `\`, "-").Replace(s)
+}
+
+// Name returns the path, relative to the folder of dl and with forward
+// slashes, that a file of dl with the extension ext should have.
+func (n *Namer) Name(dl *Download, ext string) (string, error) {
+	var buf bytes.Buffer
+	err := n.tmpl.Execute(&buf, newNameData(dl, ext))
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, part := range strings.Split(buf.String(), "/") {
+		part = cleanName(part)
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("naming template gives an empty name for %q", dl.ID)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+var (
+	emptyBracketsRE = regexp.MustCompile(`\(\s*\)|\[\s*\]`)
+	spacesRE        = regexp.MustCompile(`\s+`)
+)
+
+// maxNameBytes is the longest file name most filesystems allow.
+const maxNameBytes = 255
+
+// cleanName makes s safe as a file or directory name on Linux, macOS and
+// Windows alike. It returns the empty string if nothing is left of s.
+func cleanName(s string) string {
+	// macOS writes file names decomposed, and the same song would otherwise
+	// be named differently depending on where its metadata came from.
+	s = norm.NFC.String(s)
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune(`<>:"\|?*`, r):
+			return '_'
+		case unicode.IsControl(r):
+			return ' '
+		}
+		return r
+	}, s)
+	// Missing fields leave behind empty brackets, as in "Title ().ogg".
+	s = emptyBracketsRE.ReplaceAllString(s, "")
+	s = spacesRE.ReplaceAllString(s, " ")
+	s = strings.Replace(s, " .", ".", -1)
+	// Windows drops trailing dots and spaces, and leading ones make
+	// hidden files or look like options.
+	s = strings.Trim(s, " .-")
+	if s == "" {
+		return ""
+	}
+
+	ext := path.Ext(s)
+	stem := strings.TrimSuffix(s, ext)
+	if isReservedName(stem) {
+		stem += "_"
+	}
+	if len(stem)+len(ext) > maxNameBytes {
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem = truncateUTF8(stem, maxNameBytes-len(ext))
+	}
+	return stem + ext
+}
+
+// isReservedName returns whether Windows reserves name for a device.
+func isReservedName(name string) bool {
+	switch strings.ToUpper(name) {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(name) == 4 && name[3] >= '1' && name[3] <= '9' {
+		prefix := strings.ToUpper(name[:3])
+		return prefix == "COM" || prefix == "LPT"
+	}
+	return false
+}
+
+// truncateUTF8 returns the longest prefix of s of at most n bytes that does
+// not split a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// placeFile moves the file at from to where the library's naming template
+// puts it, in folder inside the folder of dl, and returns its new path.
+func (l *Library) placeFile(dl *Download, from, folder string) (string, error) {
+	to, err := l.targetPath(dl, from, folder)
+	if err != nil || to == from {
+		return to, err
+	}
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return "", err
+	}
+	return to, nil
+}
+
+// targetPath returns where the library's naming template puts the file of
+// dl at from, in folder inside the folder of dl. If another file is already there, the name gets a suffix
+// derived from the download ID, so that the same download always gets the
+// same name.
+func (l *Library) targetPath(dl *Download, from, folder string) (string, error) {
+	name, err := l.Namer.Name(dl, strings.TrimPrefix(filepath.Ext(from), "."))
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(l.Path, filepath.FromSlash(dl.Folder), filepath.FromSlash(folder))
+	return l.freePath(dl, from, filepath.Join(dir, filepath.FromSlash(name)))
+}
+
+// freePath returns want if nothing but the file at from is there, or else
+// the first free variant of it: "Name (abc123).ogg", then
+// "Name (abc123) 2.ogg" and so on. The path returned is claimed for dl
+// until unclaim, so that no other download picks it in the meantime.
+func (l *Library) freePath(dl *Download, from, want string) (string, error) {
+	l.claimsMu.Lock()
+	defer l.claimsMu.Unlock()
+	sum := sha256.Sum256([]byte(dl.ID))
+	suffix := hex.EncodeToString(sum[:3])
+	ext := filepath.Ext(want)
+	stem := strings.TrimSuffix(want, ext)
+	for i := 0; ; i++ {
+		path := want
+		switch {
+		case i == 1:
+			path = stem + " (" + suffix + ")" + ext
+		case i > 1:
+			path = fmt.Sprintf("%s (%s) %d%s", stem, suffix, i, ext)
+		}
+		if path == from {
+			return path, nil
+		}
+		taken, err := l.pathTaken(dl, path)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			if l.claims == nil {
+				l.claims = map[string]string{}
+			}
+			l.claims[path] = dl.ID
+			return path, nil
+		}
+	}
+}
+
+// unclaim releases the paths freePath claimed for dl.
+func (l *Library) unclaim(dl *Download) {
+	l.claimsMu.Lock()
+	defer l.claimsMu.Unlock()
+	for path, id := range l.claims {
+		if id == dl.ID {
+			delete(l.claims, path)
+		}
+	}
+}
+
+// pathTaken returns whether path is in use, on disk, in the history or by a
+// download in progress, by anything other than dl.
+func (l *Library) pathTaken(dl *Download, path string) (bool, error) {
+	if id, ok := l.claims[path]; ok && id != dl.ID {
+		return true, nil
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	rel, err := l.relPath(path)
+	if err != nil {
+		return false, err
+	}
+	owner, err := l.ByFile(rel)
+	if err != nil {
+		return false, err
+	}
+	return owner != nil && owner.ID != dl.ID, nil
+}
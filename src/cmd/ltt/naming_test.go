@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Artist - Song.ogg", "Artist - Song.ogg"},
+		// Decomposed, as macOS writes names, and composed.
+		{"Bjo\u0308rk.ogg", "Bj\u00f6rk.ogg"},
+		{"Bj\u00f6rk.ogg", "Bj\u00f6rk.ogg"},
+		{`AC/DC: "Live"?.ogg`, "AC/DC_ _Live__.ogg"},
+		{"Song ().ogg", "Song.ogg"},
+		{"Song [ ] (live).ogg", "Song (live).ogg"},
+		{"Tab\tand\nnewline.ogg", "Tab and newline.ogg"},
+		{"  .hidden ", "hidden"},
+		{"-rf.ogg", "rf.ogg"},
+		{"Song...", "Song"},
+		{"CON", "CON_"},
+		{"con.ogg", "con_.ogg"},
+		{"NUL.mp3", "NUL_.mp3"},
+		{"COM1.ogg", "COM1_.ogg"},
+		{"LPT9", "LPT9_"},
+		{"COM0.ogg", "COM0.ogg"},
+		{"CONCERT.ogg", "CONCERT.ogg"},
+		{"()", ""},
+		{" . ", ""},
+	}
+	for _, tt := range tests {
+		if got := cleanName(tt.name); got != tt.want {
+			t.Errorf("cleanName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCleanNameTruncates(t *testing.T) {
+	// é is two bytes, so 255 bytes would split one.
+	long := strings.Repeat("é", 200) + ".ogg"
+	got := cleanName(long)
+	if len(got) > maxNameBytes || !utf8.ValidString(got) || !strings.HasSuffix(got, ".ogg") {
+		t.Errorf("cleanName of %d bytes = %d bytes %q", len(long), len(got), got)
+	}
+	if len(got) < maxNameBytes-1 {
+		t.Errorf("cleanName truncated %d bytes to %d", len(long), len(got))
+	}
+
+	// An extension that long is not one, and goes rather than the stem.
+	got = cleanName(strings.Repeat("a", 250) + "." + strings.Repeat("b", 20))
+	if got != strings.Repeat("a", 250) {
+		t.Errorf("cleanName kept a long extension: %q", got)
+	}
+}
+
+func TestNamer(t *testing.T) {
+	n, err := NewNamer("{{.Genre}}/{{.Artist}} - {{.Title}} ({{.Year}}).{{.Ext}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		track Track
+		want  string
+	}{
+		{Track{Artist: "Artist", Title: "Song", Genres: []string{"Jazz"}, Year: 1971}, "Jazz/Artist - Song (1971).ogg"},
+		// Slashes in metadata do not make directories.
+		{Track{Artist: "AC/DC", Title: "Song", Genres: []string{"Rock/Metal"}}, "Rock-Metal/AC-DC - Song.ogg"},
+		{Track{}, "Unknown Genre/Unknown Artist - Untitled.ogg"},
+		{Track{Artist: "CON", Title: "Song", Genres: []string{"NUL"}}, "NUL_/CON - Song.ogg"},
+	}
+	for _, tt := range tests {
+		got, err := n.Name(&Download{Track: tt.track}, "ogg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Name(%+v) = %q, want %q", tt.track, got, tt.want)
+		}
+	}
+
+	_, err = NewNamer("{{.Album}}.{{.Ext}}")
+	if err == nil {
+		t.Errorf("NewNamer accepted a missing field")
+	}
+}
+
+func TestFreePath(t *testing.T) {
+	lib := testLibrary(t)
+	a := testPost(t, "a", "https://youtu.be/dQw4w9WgXcQ")
+	b := testPost(t, "b", "https://youtu.be/dQw4w9WgXcQ")
+	want := filepath.Join(lib.Path, "Song.ogg")
+
+	got, err := lib.freePath(a, "", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("free path is %q, want %q", got, want)
+	}
+	// a claimed it, so b gets a name derived from its own ID, the same
+	// every time.
+	sum := sha256.Sum256([]byte(b.ID))
+	suffixed := filepath.Join(lib.Path, "Song ("+hex.EncodeToString(sum[:3])+").ogg")
+	for i := 0; i < 2; i++ {
+		got, err = lib.freePath(b, "", want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != suffixed {
+			t.Fatalf("taken path gives %q, want %q", got, suffixed)
+		}
+		lib.unclaim(b)
+	}
+
+	// A file on disk takes the path as well, even once a has let go.
+	lib.unclaim(a)
+	err = ioutil.WriteFile(want, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(suffixed, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = lib.freePath(b, "", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.TrimSuffix(suffixed, ".ogg") + " 2.ogg"; got != want {
+		t.Errorf("with both taken, got %q, want %q", got, want)
+	}
+	// A file may stay where it is.
+	got, err = lib.freePath(b, suffixed, suffixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != suffixed {
+		t.Errorf("moving a file onto itself gives %q", got)
+	}
+}
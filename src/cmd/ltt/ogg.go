@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// oggPage is a page of an Ogg bitstream, as described in RFC 3533.
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	seq        uint32
+
+	// lacing holds the segment sizes, which delimit the packets in
+	// data: a segment shorter than 255 bytes ends a packet.
+	lacing []byte
+	data   []byte
+}
+
+// oggContinued is the header type of a page that continues a packet from
+// the page before.
+const oggContinued = 0x01
+
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func oggCRC(b []byte) uint32 {
+	var crc uint32
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+func readOggPage(r io.Reader) (*oggPage, error) {
+	var h [27]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(h[:4]) != "OggS" || h[4] != 0 {
+		return nil, fmt.Errorf("not an Ogg page")
+	}
+	p := &oggPage{
+		headerType: h[5],
+		granule:    binary.LittleEndian.Uint64(h[6:]),
+		serial:     binary.LittleEndian.Uint32(h[14:]),
+		seq:        binary.LittleEndian.Uint32(h[18:]),
+		lacing:     make([]byte, h[26]),
+	}
+	_, err = io.ReadFull(r, p.lacing)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	size := 0
+	for _, n := range p.lacing {
+		size += int(n)
+	}
+	p.data = make([]byte, size)
+	_, err = io.ReadFull(r, p.data)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return p, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (p *oggPage) bytes() []byte {
+	b := make([]byte, 27, 27+len(p.lacing)+len(p.data))
+	copy(b, "OggS")
+	b[5] = p.headerType
+	binary.LittleEndian.PutUint64(b[6:], p.granule)
+	binary.LittleEndian.PutUint32(b[14:], p.serial)
+	binary.LittleEndian.PutUint32(b[18:], p.seq)
+	b[26] = byte(len(p.lacing))
+	b = append(b, p.lacing...)
+	b = append(b, p.data...)
+	binary.LittleEndian.PutUint32(b[22:], oggCRC(b))
+	return b
+}
+
+// oggPaginate lays packets out in pages of the stream serial, numbered from
+// seq, for header packets that have no granule position.
+func oggPaginate(packets [][]byte, serial, seq uint32) []*oggPage {
+	var pages []*oggPage
+	var p *oggPage
+	for _, packet := range packets {
+		rest := packet
+		for {
+			if p == nil || len(p.lacing) == 255 {
+				continued := p != nil && p.lacing[254] == 255
+				if p != nil {
+					pages = append(pages, p)
+					seq++
+				}
+				p = &oggPage{serial: serial, seq: seq, granule: ^uint64(0)}
+				if continued {
+					p.headerType = oggContinued
+				}
+			}
+			n := len(rest)
+			if n > 255 {
+				n = 255
+			}
+			p.lacing = append(p.lacing, byte(n))
+			p.data = append(p.data, rest[:n]...)
+			rest = rest[n:]
+			if n < 255 {
+				// The packet ends on this page.
+				p.granule = 0
+				break
+			}
+		}
+	}
+	if p != nil {
+		pages = append(pages, p)
+	}
+	return pages
+}
+
+// oggCodec is the codec of an Ogg stream, which decides how its comment
+// header is laid out.
+type oggCodec struct {
+	// headers is the number of header packets.
+	headers int
+
+	// commentPrefix starts the comment header.
+	commentPrefix string
+
+	// framingBit is whether the comment header ends with a framing bit.
+	framingBit bool
+}
+
+func detectOggCodec(id []byte) (*oggCodec, error) {
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")):
+		return &oggCodec{3, "\x03vorbis", true}, nil
+	case bytes.HasPrefix(id, []byte("OpusHead")):
+		return &oggCodec{2, "OpusTags", false}, nil
+	}
+	return nil, fmt.Errorf("unsupported Ogg codec")
+}
+
+// oggHeaders are the header packets at the start of an Ogg stream.
+type oggHeaders struct {
+	// first is the page of the identification header.
+	first *oggPage
+	codec *oggCodec
+
+	packets [][]byte
+
+	// seq is the sequence number of the last header page.
+	seq uint32
+}
+
+// readOggHeaders reads the pages up to the end of the header packets,
+// which must end a page of their own.
+func readOggHeaders(r io.Reader) (*oggHeaders, error) {
+	h := &oggHeaders{}
+	var packet []byte
+	for h.codec == nil || len(h.packets) < h.codec.headers || len(packet) > 0 {
+		p, err := readOggPage(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Ogg headers: %v", unexpectedEOF(err))
+		}
+		if h.first == nil {
+			h.first = p
+		} else if p.serial != h.first.serial {
+			return nil, fmt.Errorf("multiplexed Ogg streams are not supported")
+		}
+		h.seq = p.seq
+		off := 0
+		for _, n := range p.lacing {
+			packet = append(packet, p.data[off:off+int(n)]...)
+			off += int(n)
+			if n < 255 {
+				h.packets = append(h.packets, packet)
+				packet = nil
+			}
+		}
+		if h.codec == nil && len(h.packets) > 0 {
+			h.codec, err = detectOggCodec(h.packets[0])
+			if err != nil {
+				return nil, err
+			}
+			if len(h.packets) != 1 || len(packet) > 0 {
+				return nil, fmt.Errorf("Ogg identification header is not on a page of its own")
+			}
+		}
+	}
+	if len(h.packets) != h.codec.headers {
+		return nil, fmt.Errorf("Ogg header packets share a page with audio")
+	}
+	if !bytes.HasPrefix(h.packets[1], []byte(h.codec.commentPrefix)) {
+		return nil, fmt.Errorf("missing Ogg comment header")
+	}
+	return h, nil
+}
+
+// comments parses the comment header.
+func (h *oggHeaders) comments() (vendor string, comments []string, err error) {
+	return parseVorbisComment(h.packets[1][len(h.codec.commentPrefix):])
+}
+
+// readOggTags returns the Vorbis comments of the Ogg Vorbis or Opus file
+// at path.
+func readOggTags(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := readOggHeaders(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	_, comments, err := h.comments()
+	return comments, err
+}
+
+// writeOggTags rewrites the comment header of the Ogg Vorbis or Opus file
+// at path with tags, keeping other comments.
+func writeOggTags(path string, tags *Tags) error {
+	return rewriteFile(path, func(r *bufio.Reader, w io.Writer) error {
+		h, err := readOggHeaders(r)
+		if err != nil {
+			return err
+		}
+		vendor, comments, err := h.comments()
+		if err != nil {
+			return err
+		}
+		var extra []tagField
+		if tags.Cover != nil {
+			extra = append(extra, tagField{"METADATA_BLOCK_PICTURE",
+				base64.StdEncoding.EncodeToString(encodeFLACPicture(tags.Cover))})
+		}
+		comment := append([]byte(h.codec.commentPrefix), buildVorbisComment(vendor, tags.merge(comments, extra...))...)
+		if h.codec.framingBit {
+			comment = append(comment, 1)
+		}
+		h.packets[1] = comment
+
+		_, err = w.Write(h.first.bytes())
+		if err != nil {
+			return err
+		}
+		pages := oggPaginate(h.packets[1:], h.first.serial, h.first.seq+1)
+		for _, p := range pages {
+			_, err = w.Write(p.bytes())
+			if err != nil {
+				return err
+			}
+		}
+
+		// Renumber the audio pages after the new header pages.
+		delta := pages[len(pages)-1].seq - h.seq
+		for {
+			p, err := readOggPage(r)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if p.serial != h.first.serial {
+				return fmt.Errorf("multiplexed Ogg streams are not supported")
+			}
+			p.seq += delta
+			_, err = w.Write(p.bytes())
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// parseVorbisComment parses a Vorbis comment header, without the codec's
+// prefix, as used by Vorbis, Opus and FLAC.
+func parseVorbisComment(b []byte) (vendor string, comments []string, err error) {
+	next := func() (string, error) {
+		if len(b) < 4 {
+			return "", fmt.Errorf("truncated Vorbis comment")
+		}
+		n := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if uint64(n) > uint64(len(b)) {
+			return "", fmt.Errorf("truncated Vorbis comment")
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s, nil
+	}
+	vendor, err = next()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("truncated Vorbis comment")
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		c, err := next()
+		if err != nil {
+			return "", nil, err
+		}
+		comments = append(comments, c)
+	}
+	return vendor, comments, nil
+}
+
+// buildVorbisComment returns a Vorbis comment header, without the codec's
+// prefix or framing bit.
+func buildVorbisComment(vendor string, comments []string) []byte {
+	var b []byte
+	put := func(s string) {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(s)))
+		b = append(b, s...)
+	}
+	put(vendor)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(comments)))
+	for _, c := range comments {
+		put(c)
+	}
+	return b
+}
+
+// rewriteFile replaces the file at path with what rewrite writes, given
+// the file's contents. The file is only replaced if rewrite succeeds.
+func rewriteFile(path string, rewrite func(r *bufio.Reader, w io.Writer) error) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".tagging"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(out)
+	err = rewrite(bufio.NewReader(in), bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testOggSerial = 0x1234
+
+// vorbisComment returns a Vorbis comment header packet.
+func vorbisComment(comments ...string) []byte {
+	b := append([]byte("\x03vorbis"), buildVorbisComment("test", comments)...)
+	return append(b, 1)
+}
+
+// oggStream returns an Ogg Vorbis stream with the comment header comment,
+// and the audio pages that follow the headers.
+func oggStream(comment []byte) (stream []byte, audio []*oggPage) {
+	id := &oggPage{headerType: 0x02, serial: testOggSerial, lacing: []byte{30}, data: make([]byte, 30)}
+	copy(id.data, "\x01vorbis")
+	setup := append([]byte("\x05vorbis"), bytes.Repeat([]byte{0xaa}, 300)...)
+	pages := append([]*oggPage{id}, oggPaginate([][]byte{comment, setup}, testOggSerial, 1)...)
+
+	seq := pages[len(pages)-1].seq
+	for i := 0; i < 3; i++ {
+		seq++
+		data := bytes.Repeat([]byte{byte(i)}, 100+i)
+		audio = append(audio, &oggPage{serial: testOggSerial, seq: seq, granule: uint64(1000 * (i + 1)),
+			lacing: []byte{byte(len(data))}, data: data})
+	}
+	audio[len(audio)-1].headerType = 0x04
+
+	var b bytes.Buffer
+	for _, p := range append(pages, audio...) {
+		b.Write(p.bytes())
+	}
+	return b.Bytes(), audio
+}
+
+// checkOggPages checks the CRC and sequence number of every page of b,
+// and returns them.
+func checkOggPages(t *testing.T, b []byte) []*oggPage {
+	var pages []*oggPage
+	for len(b) > 0 {
+		p, err := readOggPage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("page %d: %v", len(pages), err)
+		}
+		n := 27 + len(p.lacing) + len(p.data)
+		raw := append([]byte(nil), b[:n]...)
+		want := binary.LittleEndian.Uint32(raw[22:])
+		copy(raw[22:26], []byte{0, 0, 0, 0})
+		if got := oggCRC(raw); got != want {
+			t.Errorf("page %d: CRC %08x, want %08x", len(pages), got, want)
+		}
+		if p.seq != uint32(len(pages)) {
+			t.Errorf("page %d: sequence number %d", len(pages), p.seq)
+		}
+		pages = append(pages, p)
+		b = b[n:]
+	}
+	return pages
+}
+
+func TestWriteOggTagsAcrossPages(t *testing.T) {
+	stream, audio := oggStream(vorbisComment("ARTIST=Old", "ENCODER=x"))
+	path := filepath.Join(t.TempDir(), "song.ogg")
+	err := ioutil.WriteFile(path, stream, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cover much larger than a page holds, as thumbnails are.
+	cover := make([]byte, 150000)
+	rand.New(rand.NewSource(1)).Read(cover)
+	tags := &Tags{Cover: &Picture{MIME: "image/jpeg", Width: 1, Height: 1, Data: cover}}
+	tags.Add("ARTIST", "New")
+	tags.Add("TITLE", "Song")
+	err = writeOggTags(path, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := checkOggPages(t, b)
+	if len(pages) < 5+len(audio) {
+		t.Fatalf("comment header fits in %d pages", len(pages)-1-len(audio))
+	}
+	for i, p := range pages[2 : len(pages)-len(audio)] {
+		if p.headerType&oggContinued == 0 {
+			t.Errorf("header page %d does not continue a packet", i+2)
+		}
+	}
+	for i, p := range pages[len(pages)-len(audio):] {
+		want := audio[i]
+		if p.granule != want.granule || p.headerType != want.headerType || !bytes.Equal(p.data, want.data) {
+			t.Errorf("audio page %d changed", i)
+		}
+	}
+
+	comments, err := readOggTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 4 || !strings.HasPrefix(comments[3], "METADATA_BLOCK_PICTURE=") {
+		t.Fatalf("comments %q", comments)
+	}
+	if want := []string{"ENCODER=x", "ARTIST=New", "TITLE=Song"}; !reflect.DeepEqual(comments[:3], want) {
+		t.Errorf("comments %q, want %q", comments[:3], want)
+	}
+}
+
+func TestOggPaginateMultipleOf255(t *testing.T) {
+	for _, size := range []int{255, 510, 255 * 255, 2 * 255 * 255} {
+		packet := bytes.Repeat([]byte{'x'}, size)
+		pages := oggPaginate([][]byte{packet, []byte("next")}, testOggSerial, 1)
+
+		var packets [][]byte
+		var cur []byte
+		for i, p := range pages {
+			if p.seq != uint32(1+i) {
+				t.Errorf("%d bytes: page %d has sequence number %d", size, i, p.seq)
+			}
+			if continued := i > 0 && pages[i-1].lacing[len(pages[i-1].lacing)-1] == 255; continued != (p.headerType&oggContinued != 0) {
+				t.Errorf("%d bytes: page %d continued flag wrong", size, i)
+			}
+			off := 0
+			for _, n := range p.lacing {
+				cur = append(cur, p.data[off:off+int(n)]...)
+				off += int(n)
+				if n < 255 {
+					packets = append(packets, cur)
+					cur = nil
+				}
+			}
+		}
+		// A packet that fills its last segment needs an empty one to end.
+		if len(packets) != 2 || !bytes.Equal(packets[0], packet) || string(packets[1]) != "next" {
+			t.Errorf("%d bytes: packets do not survive pagination", size)
+		}
+	}
+}
+
+func TestReadOggHeadersMultipleOf255(t *testing.T) {
+	// Pad the comment header out to exactly two pages' worth of segments.
+	base := len(vorbisComment("X="))
+	comment := vorbisComment("X=" + strings.Repeat("a", 2*255*255-base))
+	if len(comment)%255 != 0 {
+		t.Fatalf("comment header is %d bytes", len(comment))
+	}
+	stream, _ := oggStream(comment)
+	h, err := readOggHeaders(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.packets[1], comment) {
+		t.Errorf("comment header is %d bytes, want %d", len(h.packets[1]), len(comment))
+	}
+	if len(h.packets) != 3 || !bytes.HasPrefix(h.packets[2], []byte("\x05vorbis")) {
+		t.Errorf("setup header lost")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/boltdb/bolt"
+)
+
+// Actions a dry run can plan for a post.
+const (
+	PlanDownload    = "download"
+	PlanRetry       = "retry"
+	PlanSkip        = "skip"
+	PlanPresent     = "present"
+	PlanRepost      = "repost"
+	PlanDeferred    = "deferred"
+	PlanUnsupported = "unsupported"
+)
+
+// planRow is what a fetch would do with a post.
+type planRow struct {
+	feed   string
+	id     string
+	action string
+	track  string
+	reason string
+
+	// via is the resolver and downloader the post would be downloaded
+	// with, such as "youtube/yt-dlp".
+	via string
+}
+
+// plan returns what queueing dl would do, and why, without writing to the
+// history: the same checks as transition makes when queueing.
+func (l *Library) plan(dl *Download) (action, reason string, err error) {
+	err = l.View(func(tx *bolt.Tx) error {
+		prev, orig, err := l.decide(tx, dl)
+		switch err {
+		case nil:
+		case ErrAlreadyDownloaded:
+			action = PlanPresent
+			return nil
+		case ErrRepost:
+			action, reason = PlanPresent, "repost of "+prev.Original
+			return nil
+		case ErrDead, ErrNotDue, ErrInProgress:
+			action, reason = PlanDeferred, err.Error()
+			return nil
+		default:
+			return err
+		}
+		switch {
+		case orig != nil:
+			action, reason = PlanRepost, "of "+orig.ID
+		case prev != nil && prev.CurrentState() == StateFailed:
+			action, reason = PlanRetry, prev.Error
+		default:
+			action = PlanDownload
+		}
+		return nil
+	})
+	return action, reason, err
+}
+
+// addPlan records what a dry run would do with dl. Posts found in more
+// than one feed, or linking media already planned, are only downloaded
+// once.
+func (p *poller) addPlan(feed string, dl *Download, action, reason string) {
+	if action == PlanDownload || action == PlanRetry {
+		if first, ok := p.planned[dl.ID]; ok {
+			action, reason = PlanPresent, "also in "+first
+		} else if first, ok := p.planned[dl.MediaID]; ok && dl.MediaID != "" {
+			action, reason = PlanRepost, "of "+first
+		} else {
+			p.planned[dl.ID] = feed
+			if dl.MediaID != "" {
+				p.planned[dl.MediaID] = dl.ID
+			}
+		}
+	}
+	p.plan = append(p.plan, planRow{feed, dl.ID, action, dl.Track.String(), reason, p.lib.via(dl)})
+}
+
+// via returns the resolver and the first downloader that would be tried for
+// dl, or "none" for the downloader if none supports it.
+func (l *Library) via(dl *Download) string {
+	for _, d := range l.Downloaders {
+		if d.Supports(dl.Backend) {
+			return dl.site() + "/" + d.Name()
+		}
+	}
+	return dl.site() + "/none"
+}
+
+// printPlan prints what the dry run would have done.
+func (p *poller) printPlan() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FEED\tACTION\tID\tTRACK\tVIA\tREASON")
+	counts := map[string]int{}
+	for _, r := range p.plan {
+		counts[r.action]++
+		via := r.via
+		if via == "" {
+			via = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.feed, r.action, r.id, r.track, via, r.reason)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("\n%d to download, %d to retry, %d skipped, %d already present, %d reposts, %d deferred, %d unsupported\n",
+		counts[PlanDownload], counts[PlanRetry], counts[PlanSkip], counts[PlanPresent],
+		counts[PlanRepost], counts[PlanDeferred], counts[PlanUnsupported])
+	return err
+}
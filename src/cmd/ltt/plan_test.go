@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPlan(t *testing.T) {
+	lib := testLibrary(t)
+	done := testPost(t, "a", "https://youtu.be/dQw4w9WgXcQ")
+	err := lib.Queue(done)
+	if err == nil {
+		err = lib.transition(done, StateDone, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := testPost(t, "b", "https://vimeo.com/123456")
+	err = lib.Queue(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dl     *Download
+		action string
+	}{
+		{done, PlanPresent},
+		{testPost(t, "c", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"), PlanRepost},
+		{testPost(t, "d", "https://vimeo.com/123456"), PlanDeferred},
+		{testPost(t, "e", "https://vimeo.com/654321"), PlanDownload},
+	}
+	for _, tt := range tests {
+		action, reason, err := lib.plan(tt.dl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != tt.action {
+			t.Errorf("plan(%q) = %s (%s), want %s", tt.dl.ID, action, reason, tt.action)
+		}
+		// Queueing must agree with the plan.
+		err = lib.Queue(tt.dl)
+		switch tt.action {
+		case PlanPresent:
+			if err != ErrAlreadyDownloaded {
+				t.Errorf("queueing %q: %v", tt.dl.ID, err)
+			}
+		case PlanRepost:
+			if err != ErrRepost {
+				t.Errorf("queueing %q: %v", tt.dl.ID, err)
+			}
+		case PlanDeferred:
+			if err != ErrInProgress {
+				t.Errorf("queueing %q: %v", tt.dl.ID, err)
+			}
+		case PlanDownload:
+			if err != nil {
+				t.Errorf("queueing %q: %v", tt.dl.ID, err)
+			}
+		}
+	}
+}
+
+func TestPlanReadOnlyWithoutMediaIndex(t *testing.T) {
+	lib := testLibrary(t)
+	done := testPost(t, "a", "https://youtu.be/dQw4w9WgXcQ")
+	err := lib.Queue(done)
+	if err == nil {
+		err = lib.transition(done, StateDone, nil)
+	}
+	if err == nil {
+		// As histories from before reposts were recognized.
+		err = lib.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(mediaBucket) })
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.Close()
+
+	ro, err := openReadOnlyLibrary(&Config{Library: lib.Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	action, _, err := ro.plan(testPost(t, "b", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != PlanRepost {
+		t.Errorf("repost planned as %s", action)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Pool archives downloads concurrently, with a limit on the number of
+// downloads overall and per site.
+type Pool struct {
+	lib  *Library
+	stop <-chan struct{}
+
+	slots     chan struct{}
+	siteLimit map[string]int
+
+	mu        sync.Mutex
+	siteSlots map[string]chan struct{}
+	inflight  map[string]bool
+	summary   Summary
+	wg        sync.WaitGroup
+}
+
+// NewPool returns a pool that archives into lib, running at most limit
+// downloads at once, and at most siteLimit[site] at once from a site.
+// Sites are named by resolver, such as "youtube".
+func NewPool(lib *Library, limit int, siteLimit map[string]int) *Pool {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Pool{
+		lib:       lib,
+		slots:     make(chan struct{}, limit),
+		siteLimit: siteLimit,
+		siteSlots: map[string]chan struct{}{},
+		inflight:  map[string]bool{},
+	}
+}
+
+// site returns the name of the site dl is downloaded from, for concurrency
+// limits: the resolver name, or the host if there is none.
+func (dl *Download) site() string {
+	if i := strings.Index(dl.MediaID, ":"); i > 0 {
+		return dl.MediaID[:i]
+	}
+	return dl.URL.Host
+}
+
+func (p *Pool) siteSlot(site string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limit, ok := p.siteLimit[site]
+	if !ok || limit < 1 {
+		return nil
+	}
+	slot, ok := p.siteSlots[site]
+	if !ok {
+		slot = make(chan struct{}, limit)
+		p.siteSlots[site] = slot
+	}
+	return slot
+}
+
+func (p *Pool) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Submit queues dl to be archived, unless it is already queued or done.
+// It does not wait for the download, but returns why dl was not queued, if
+// it was not, such as ErrInProgress.
+func (p *Pool) Submit(dl *Download) error {
+	p.mu.Lock()
+	if p.inflight[dl.ID] {
+		p.mu.Unlock()
+		return nil
+	}
+	p.inflight[dl.ID] = true
+	p.mu.Unlock()
+
+	err := p.lib.Queue(dl)
+	if err != nil {
+		p.done(dl)
+		if err == ErrAlreadyDownloaded {
+			p.record(func(s *Summary) { s.Present++ })
+		} else if err == ErrRepost {
+			if dl.Original != "" {
+				log.Printf("%q is a repost of %q", dl.ID, dl.Original)
+			}
+			p.record(func(s *Summary) { s.Present++ })
+		} else if err == ErrNotDue || err == ErrDead || err == ErrInProgress {
+			p.record(func(s *Summary) { s.Deferred++ })
+		} else {
+			log.Printf("failed to queue %q: %v", dl.ID, err)
+			p.record(func(s *Summary) { s.Failed = append(s.Failed, Failure{dl.ID, err}) })
+		}
+		return err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.done(dl)
+
+		// Wait for the site first, so that a busy site does not hold
+		// up downloads from the others.
+		if slot := p.siteSlot(dl.site()); slot != nil {
+			slot <- struct{}{}
+			defer func() { <-slot }()
+		}
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+
+		if p.stopped() {
+			if err := p.lib.Unqueue(dl); err != nil {
+				log.Printf("failed to unqueue %q: %v", dl.ID, err)
+			}
+			return
+		}
+		p.archive(dl)
+	}()
+	return nil
+}
+
+func (p *Pool) done(dl *Download) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inflight, dl.ID)
+}
+
+func (p *Pool) archive(dl *Download) {
+	err := p.lib.Archive(dl)
+	if err == ErrAlreadyDownloaded {
+		p.record(func(s *Summary) { s.Present++ })
+		return
+	} else if err == errInterrupted {
+		p.record(func(s *Summary) { s.Deferred++ })
+		return
+	} else if err != nil {
+		log.Printf("failed to archive %q: %v", dl.ID, err)
+		p.record(func(s *Summary) { s.Failed = append(s.Failed, Failure{dl.ID, err}) })
+		return
+	}
+	log.Printf("downloaded %q", dl.ID)
+	p.record(func(s *Summary) { s.Downloaded = append(s.Downloaded, dl.ID) })
+}
+
+func (p *Pool) record(f func(*Summary)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(&p.summary)
+}
+
+// Wait waits for all submitted downloads to finish, and returns a summary
+// of them. The pool can be used again afterwards.
+func (p *Pool) Wait() Summary {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.summary
+	p.summary = Summary{}
+	return s
+}
+
+// Failure is a download that failed.
+type Failure struct {
+	ID  string
+	Err error
+}
+
+// Summary counts the outcomes of a run of downloads.
+type Summary struct {
+	Downloaded []string
+	Failed     []Failure
+
+	// Present counts downloads skipped because they were already in the
+	// history.
+	Present int
+
+	// Deferred counts downloads put off because they are waiting for a
+	// retry, have been given up on, or their media is being downloaded
+	// from another post.
+	Deferred int
+}
+
+// Empty returns whether nothing was attempted.
+func (s Summary) Empty() bool {
+	return len(s.Downloaded) == 0 && len(s.Failed) == 0 && s.Present == 0 && s.Deferred == 0
+}
+
+func (s Summary) String() string {
+	text := fmt.Sprintf("%d downloaded, %d failed, %d already downloaded, %d deferred",
+		len(s.Downloaded), len(s.Failed), s.Present, s.Deferred)
+	sort.Slice(s.Failed, func(i, j int) bool { return s.Failed[i].ID < s.Failed[j].ID })
+	for _, f := range s.Failed {
+		text += fmt.Sprintf("\n  %s: %v", f.ID, f.Err)
+	}
+	return text
+}
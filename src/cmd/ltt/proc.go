@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Child processes, such as youtube-dl and ffmpeg, run in process groups of
+// their own, so that the Ctrl-C or SIGTERM meant for ltt does not reach
+// them: the daemon finishes the song it is on before it exits, and ltt
+// kills them itself when it cannot wait.
+var children struct {
+	sync.Mutex
+	running map[*os.Process]bool
+}
+
+// childCommand returns a command that runs name in a process group of its own.
+// Run it with runChild or childOutput, so that it is killed with ltt.
+func childCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	setProcessGroup(cmd)
+	return cmd
+}
+
+// runChild runs cmd, keeping track of it while it runs.
+func runChild(cmd *exec.Cmd) error {
+	children.Lock()
+	err := cmd.Start()
+	if err == nil {
+		if children.running == nil {
+			children.running = map[*os.Process]bool{}
+		}
+		children.running[cmd.Process] = true
+	}
+	children.Unlock()
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	children.Lock()
+	delete(children.running, cmd.Process)
+	children.Unlock()
+	return err
+}
+
+// childOutput runs cmd with runChild, and returns its standard output.
+func childOutput(cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := runChild(cmd)
+	return stdout.Bytes(), err
+}
+
+// killChildren kills the running child processes, along with anything they
+// started.
+func killChildren() {
+	children.Lock()
+	defer children.Unlock()
+	for p := range children.running {
+		killProcessGroup(p)
+	}
+}
+
+var stopSignal struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// stopOnSignal returns a channel that is closed on the first SIGINT or
+// SIGTERM, for commands that finish what they are doing before they exit.
+// A second signal stops them at once.
+func stopOnSignal() <-chan struct{} {
+	stopSignal.Lock()
+	defer stopSignal.Unlock()
+	if stopSignal.stop == nil {
+		stopSignal.stop = make(chan struct{})
+	}
+	return stopSignal.stop
+}
+
+// catchSignals handles SIGINT and SIGTERM: the first closes the channel of
+// stopOnSignal, if a command asked for one. Otherwise, or on the next,
+// ltt kills its children and exits. Records left downloading are retried
+// on the next run.
+func catchSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		stopSignal.Lock()
+		stop := stopSignal.stop
+		stopSignal.Unlock()
+		if stop != nil {
+			log.Printf("received %v, shutting down after the current download; again to stop now", sig)
+			close(stop)
+			sig = <-sigs
+		}
+		log.Printf("received %v, stopping now", sig)
+		killChildren()
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Console signals reach the whole console on Windows regardless.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(p *os.Process) {
+	p.Kill()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Query selects downloads from the history. Zero fields match everything.
+type Query struct {
+	// Since and Until limit the post date to [Since, Until).
+	Since, Until time.Time
+
+	// Genre matches downloads with a genre containing it.
+	Genre string
+
+	State State
+
+	// Subreddit matches posts to a subreddit, such as "listentothis".
+	Subreddit string
+
+	// Feed matches downloads from the subscription with this name.
+	Feed string
+
+	// Text matches downloads with it in the title, artist, genres, ID or
+	// URL.
+	Text string
+}
+
+// Match returns whether dl is selected by q. All string matches ignore
+// case.
+func (q *Query) Match(dl *Download) bool {
+	if !q.Since.IsZero() && dl.Date.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !dl.Date.Before(q.Until) {
+		return false
+	}
+	if q.Genre != "" && matchGenre(dl.Track, q.Genre) == "" {
+		return false
+	}
+	if q.State != "" && dl.CurrentState() != q.State {
+		return false
+	}
+	if q.Subreddit != "" && !strings.EqualFold(dl.Subreddit(), strings.TrimPrefix(q.Subreddit, "r/")) {
+		return false
+	}
+	if q.Feed != "" && !strings.EqualFold(dl.Feed, q.Feed) {
+		return false
+	}
+	if q.Text != "" {
+		text := strings.ToLower(q.Text)
+		found := false
+		for _, s := range append([]string{dl.Title, dl.Track.Artist, dl.Track.Title, dl.ID, dl.MediaID, dl.URL.String()}, dl.Track.Genres...) {
+			if strings.Contains(strings.ToLower(s), text) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Subreddit returns the subreddit dl was posted to, from its permalink, or
+// the empty string if it was not posted to one.
+func (dl *Download) Subreddit() string {
+	u, err := url.Parse(dl.Link)
+	if err != nil || !strings.HasSuffix(u.Hostname(), "reddit.com") {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "r" {
+		return ""
+	}
+	return parts[1]
+}
+
+// queryFlags are the flags shared by the commands that select downloads.
+type queryFlags struct {
+	since, until, genre, state, subreddit, feed *string
+}
+
+func addQueryFlags(fs *flag.FlagSet) *queryFlags {
+	return &queryFlags{
+		since:     fs.String("since", "", "only posts submitted on or after this date (YYYY-MM-DD)"),
+		until:     fs.String("until", "", "only posts submitted before this date (YYYY-MM-DD)"),
+		genre:     fs.String("genre", "", "only songs with a genre containing this"),
+		state:     fs.String("state", "", "only downloads in this state, such as done or failed"),
+		subreddit: fs.String("subreddit", "", "only posts to this subreddit"),
+		feed:      fs.String("feed", "", "only downloads from this subscription"),
+	}
+}
+
+func (f *queryFlags) query() (*Query, error) {
+	q := &Query{
+		Genre:     *f.genre,
+		State:     State(*f.state),
+		Subreddit: *f.subreddit,
+		Feed:      *f.feed,
+	}
+	var err error
+	if *f.since != "" {
+		q.Since, err = time.ParseInLocation("2006-01-02", *f.since, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -since: %v", err)
+		}
+	}
+	if *f.until != "" {
+		q.Until, err = time.ParseInLocation("2006-01-02", *f.until, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+	switch q.State {
+	case "", StateQueued, StateDownloading, StateDone, StateFailed, StateSkipped, StateDead, StateLinked:
+	default:
+		return nil, fmt.Errorf("invalid -state %q", q.State)
+	}
+	return q, nil
+}
+
+// Find returns the downloads in the history selected by q, oldest post
+// first.
+func (l *Library) Find(q *Query) ([]*Download, error) {
+	dls, err := l.Downloads()
+	if err != nil {
+		return nil, err
+	}
+	var found []*Download
+	for _, dl := range dls {
+		if q.Match(dl) {
+			found = append(found, dl)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Date.Before(found[j].Date) })
+	return found, nil
+}
+
+func runList(cfg *Config, args []string) error {
+	fs := newFlagSet("list")
+	qf := addQueryFlags(fs)
+	jsonOut := fs.Bool("json", false, "print the records as JSON")
+	fs.Parse(args)
+	q, err := qf.query()
+	if err != nil {
+		return err
+	}
+	return listDownloads(cfg, q, *jsonOut)
+}
+
+func runSearch(cfg *Config, args []string) error {
+	fs := newFlagSet("search")
+	qf := addQueryFlags(fs)
+	jsonOut := fs.Bool("json", false, "print the records as JSON")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	q, err := qf.query()
+	if err != nil {
+		return err
+	}
+	q.Text = strings.Join(fs.Args(), " ")
+	return listDownloads(cfg, q, *jsonOut)
+}
+
+func listDownloads(cfg *Config, q *Query, jsonOut bool) error {
+	lib, err := openReadOnlyLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	dls, err := lib.Find(q)
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		if dls == nil {
+			// Scripts would rather have an empty list than null.
+			dls = []*Download{}
+		}
+		return printJSON(dls)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tDATE\tYEAR\tGENRE\tTRACK")
+	for _, dl := range dls {
+		track := dl.Track
+		year := ""
+		if track.Year != 0 {
+			year = strconv.Itoa(track.Year)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", dl.ID, dl.CurrentState(), dl.Date.Format("2006-01-02"), year, track.Genre(), track)
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", data)
+	return err
+}
+
+// recordDetails is a download with what else the history knows of it, as
+// 'ltt show' prints it.
+type recordDetails struct {
+	*Download
+
+	// Failure is the retry state of a failed download.
+	Failure *FailedDownload `json:",omitempty"`
+
+	// Reposts are the IDs of the posts linked to this one.
+	Reposts []string `json:",omitempty"`
+}
+
+func runShow(cfg *Config, args []string) error {
+	fs := newFlagSet("show")
+	jsonOut := fs.Bool("json", false, "print the record as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := fs.Arg(0)
+
+	lib, err := openReadOnlyLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	dl, err := lib.Record(id)
+	if err == nil && dl == nil {
+		// Maybe it is a media ID, such as youtube:dQw4w9WgXcQ.
+		dl, err = lib.ByMedia(id)
+	}
+	if err != nil {
+		return err
+	}
+	if dl == nil {
+		return fmt.Errorf("no record of %q", id)
+	}
+	d, err := lib.details(dl)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(d)
+	}
+	return d.print()
+}
+
+func (l *Library) details(dl *Download) (*recordDetails, error) {
+	d := &recordDetails{Download: dl}
+	err := l.View(func(tx *bolt.Tx) error {
+		var err error
+		d.Failure, err = getFailure(tx, dl.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	dls, err := l.Downloads()
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range dls {
+		if other.Original == dl.ID {
+			d.Reposts = append(d.Reposts, other.ID)
+		}
+	}
+	return d, nil
+}
+
+func (d *recordDetails) print() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", name, value)
+		}
+	}
+	t := d.Track
+	field("ID", d.ID)
+	field("State", string(d.CurrentState()))
+	field("Error", d.Error)
+	field("Updated", formatTime(d.Updated))
+	field("Title", d.Title)
+	field("Artist", t.Artist)
+	field("Track", t.Title)
+	field("Genres", strings.Join(t.Genres, ", "))
+	if t.Year != 0 {
+		field("Year", strconv.Itoa(t.Year))
+	}
+	field("Notes", t.Notes)
+	field("Posted", formatTime(d.Date))
+	field("Subreddit", d.Subreddit())
+	field("Feed", d.Feed)
+	field("Post", d.Link)
+	field("URL", d.URL.String())
+	field("Media", d.MediaID)
+	field("Original", d.Original)
+	field("Reposts", strings.Join(d.Reposts, ", "))
+	if d.Downloader != "" {
+		field("Downloader", strings.TrimSpace(d.Downloader+" "+d.DownloaderVersion))
+	}
+	for _, f := range d.Files {
+		desc := fmt.Sprintf("%s (%d bytes", f.Path, f.Size)
+		if f.Duration > 0 {
+			desc += ", " + time.Duration(f.Duration*float64(time.Second)).Round(time.Second).String()
+		}
+		if f.Loudness != nil {
+			desc += fmt.Sprintf(", %.1f LUFS", f.Loudness.Integrated)
+		}
+		if f.Profile != "" {
+			desc += ", " + f.Profile
+		}
+		field("File", desc+")")
+	}
+	if d.Cover != nil {
+		field("Cover", d.Cover.Path)
+	}
+	if d.Downloaded != nil {
+		field("Downloaded", formatTime(*d.Downloaded))
+	}
+	if d.Evicted != nil {
+		field("Evicted", formatTime(*d.Evicted))
+	}
+	if f := d.Failure; f != nil {
+		next := formatTime(f.Next)
+		if f.Dead {
+			next = "never"
+		}
+		field("Attempts", fmt.Sprintf("%d, next %s", f.Attempts, next))
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
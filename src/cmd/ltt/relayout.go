@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func runRelayout(cfg *Config, args []string) error {
+	fs := newFlagSet("relayout")
+	naming := fs.String("naming", "", "naming template to move files to (default: the configured one)")
+	dryRun := fs.Bool("dry-run", false, "print the moves without making them")
+	fs.Parse(args)
+
+	if *naming == "" {
+		*naming = cfg.Naming
+	}
+	if *naming == "" {
+		return fmt.Errorf("no naming template; set naming in the config or pass -naming")
+	}
+	namer, err := NewNamer(*naming)
+	if err != nil {
+		return err
+	}
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	lib.Namer = namer
+
+	dls, err := lib.Downloads()
+	if err != nil {
+		return err
+	}
+	moved := 0
+	for _, dl := range dls {
+		if dl.CurrentState() != StateDone {
+			continue
+		}
+		n, err := lib.relayout(dl, *dryRun)
+		moved += n
+		if err != nil {
+			return fmt.Errorf("failed to move files of %q: %v", dl.ID, err)
+		}
+	}
+	if *dryRun {
+		log.Printf("would move %d files", moved)
+	} else {
+		log.Printf("moved %d files", moved)
+	}
+	return nil
+}
+
+// relayout moves the files of dl to where the library's naming template
+// puts them, records their new paths, and returns how many it moved. If
+// dryRun is set, it only prints the moves.
+func (l *Library) relayout(dl *Download, dryRun bool) (int, error) {
+	moved := 0
+	var dirs []string
+	var err error
+	for i := range dl.Files {
+		if p := dl.Files[i].Path; inFolder(p, keepDir) || inFolder(p, trashDir) {
+			// Triaged by meh, so where it is is where it belongs.
+			continue
+		}
+		from := l.absPath(&dl.Files[i])
+		if _, serr := os.Stat(from); serr != nil {
+			log.Printf("skipping %q: %v", dl.Files[i].Path, serr)
+			continue
+		}
+		var to, rel string
+		folder := l.profileFolder(dl.Files[i].Profile)
+		to, err = l.targetPath(dl, from, folder)
+		if err == nil && to != from {
+			rel, err = l.relPath(to)
+		}
+		if err != nil {
+			break
+		}
+		if to == from {
+			continue
+		}
+		fmt.Printf("%s -> %s\n", dl.Files[i].Path, rel)
+		if !dryRun {
+			_, err = l.placeFile(dl, from, folder)
+			if err != nil {
+				break
+			}
+			dl.Files[i].Path = rel
+			dirs = append(dirs, filepath.Dir(from))
+		}
+		moved++
+	}
+	if dryRun || moved == 0 {
+		return moved, err
+	}
+	if cerr := l.moveCover(dl); cerr != nil {
+		log.Printf("failed to move cover of %q: %v", dl.ID, cerr)
+	}
+	// Record whatever was moved, even if a later file failed.
+	if serr := l.SaveFiles(dl); serr != nil {
+		return moved, serr
+	}
+	for _, dir := range dirs {
+		l.removeEmptyDirs(dir)
+	}
+	return moved, err
+}
+
+// profileFolder returns the folder of the output profile with the given
+// name, or the empty string if it is no longer an output.
+func (l *Library) profileFolder(name string) string {
+	for _, p := range l.Outputs {
+		if p.Name == name {
+			return p.Folder
+		}
+	}
+	return ""
+}
+
+// removeEmptyDirs removes dir and its parents, up to but not including the
+// library, for as long as they are empty. meh's folders are left alone.
+func (l *Library) removeEmptyDirs(dir string) {
+	for {
+		if rel, err := l.relPath(dir); err != nil || rel == "." || rel == keepDir || rel == trashDir {
+			return
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"audio"
+)
+
+// Backends that a resolver can choose to download media with.
+const (
+	// BackendMedia downloads from media sites with youtube-dl or similar.
+	BackendMedia = "media"
+
+	// BackendHTTP downloads an audio file directly.
+	BackendHTTP = "http"
+)
+
+// Media is a downloadable song, as identified by a Resolver.
+type Media struct {
+	// URL is the normalized URL of the media.
+	URL url.URL
+
+	// ID identifies the media regardless of which URL was posted, such
+	// as "youtube:dQw4w9WgXcQ".
+	ID string
+
+	// Backend is the kind of downloader the media needs.
+	Backend string
+}
+
+// Resolver recognizes media URLs on the hosts it is registered for.
+type Resolver interface {
+	// Name identifies the resolver, and prefixes the IDs of the media it
+	// resolves.
+	Name() string
+
+	// Resolve returns the media u points to, or an error explaining why
+	// it cannot be downloaded.
+	Resolve(u *url.URL) (*Media, error)
+}
+
+var resolvers = map[string]Resolver{}
+
+// RegisterResolver registers r for each of hosts. A host of the form
+// "*.example.com" matches any subdomain of example.com.
+func RegisterResolver(r Resolver, hosts ...string) {
+	for _, host := range hosts {
+		resolvers[host] = r
+	}
+}
+
+// findResolver returns the resolver registered for host, or nil.
+func findResolver(host string) Resolver {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if r, ok := resolvers[host]; ok {
+		return r
+	}
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		if r, ok := resolvers["*."+host]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// Resolve returns the media u points to, or an error explaining why ltt
+// cannot download it.
+func Resolve(u *url.URL) (*Media, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if r := findResolver(u.Hostname()); r != nil {
+		return r.Resolve(u)
+	}
+	if isAudioFile(u) {
+		return directResolver{}.Resolve(u)
+	}
+	return nil, fmt.Errorf("unsupported host %q", u.Hostname())
+}
+
+func init() {
+	RegisterResolver(youtubeResolver{},
+		"youtube.com", "www.youtube.com", "m.youtube.com", "music.youtube.com",
+		"youtube-nocookie.com", "www.youtube-nocookie.com", "youtu.be")
+	RegisterResolver(bandcampResolver{}, "*.bandcamp.com")
+	RegisterResolver(soundcloudResolver{}, "soundcloud.com", "www.soundcloud.com", "m.soundcloud.com")
+	RegisterResolver(vimeoResolver{}, "vimeo.com", "www.vimeo.com", "player.vimeo.com")
+}
+
+func mustParseURL(s string) url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return *u
+}
+
+type youtubeResolver struct{}
+
+func (youtubeResolver) Name() string { return "youtube" }
+
+var youtubeIDRE = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+func (r youtubeResolver) Resolve(u *url.URL) (*Media, error) {
+	var id string
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case strings.EqualFold(u.Hostname(), "youtu.be"):
+		id = parts[0]
+	case parts[0] == "watch":
+		id = u.Query().Get("v")
+	case len(parts) == 2 && (parts[0] == "embed" || parts[0] == "v" || parts[0] == "shorts" || parts[0] == "live"):
+		id = parts[1]
+	case parts[0] == "playlist":
+		return nil, fmt.Errorf("playlists are not supported")
+	}
+	if !youtubeIDRE.MatchString(id) {
+		return nil, fmt.Errorf("no video ID in YouTube URL %q", u)
+	}
+	return &Media{
+		URL:     mustParseURL("https://www.youtube.com/watch?v=" + id),
+		ID:      r.Name() + ":" + id,
+		Backend: BackendMedia,
+	}, nil
+}
+
+type bandcampResolver struct{}
+
+func (bandcampResolver) Name() string { return "bandcamp" }
+
+func (r bandcampResolver) Resolve(u *url.URL) (*Media, error) {
+	host := strings.ToLower(u.Hostname())
+	artist := strings.TrimSuffix(host, ".bandcamp.com")
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("not a Bandcamp track URL: %q", u)
+	}
+	switch parts[0] {
+	case "track":
+	case "album":
+		return nil, fmt.Errorf("Bandcamp albums are not supported")
+	default:
+		return nil, fmt.Errorf("not a Bandcamp track URL: %q", u)
+	}
+	return &Media{
+		URL:     mustParseURL("https://" + host + "/track/" + url.PathEscape(parts[1])),
+		ID:      r.Name() + ":" + artist + "/" + parts[1],
+		Backend: BackendMedia,
+	}, nil
+}
+
+type soundcloudResolver struct{}
+
+func (soundcloudResolver) Name() string { return "soundcloud" }
+
+func (r soundcloudResolver) Resolve(u *url.URL) (*Media, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("not a SoundCloud track URL: %q", u)
+	}
+	if parts[1] == "sets" || parts[1] == "tracks" || parts[1] == "albums" {
+		return nil, fmt.Errorf("SoundCloud %s are not supported", parts[1])
+	}
+	artist, track := strings.ToLower(parts[0]), strings.ToLower(parts[1])
+	return &Media{
+		URL:     mustParseURL("https://soundcloud.com/" + url.PathEscape(artist) + "/" + url.PathEscape(track)),
+		ID:      r.Name() + ":" + artist + "/" + track,
+		Backend: BackendMedia,
+	}, nil
+}
+
+type vimeoResolver struct{}
+
+func (vimeoResolver) Name() string { return "vimeo" }
+
+var (
+	vimeoIDRE   = regexp.MustCompile(`^[0-9]+$`)
+	vimeoHashRE = regexp.MustCompile(`^[0-9a-f]+$`)
+)
+
+// Resolve handles unlisted videos too, whose URLs carry a hash after the
+// ID, as in vimeo.com/123/abc or player.vimeo.com/video/123?h=abc. The hash
+// is needed to download them, but is not part of the media ID.
+func (r vimeoResolver) Resolve(u *url.URL) (*Media, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	id := parts[len(parts)-1]
+	var hash string
+	if strings.EqualFold(u.Hostname(), "player.vimeo.com") {
+		if len(parts) != 2 || parts[0] != "video" {
+			id = ""
+		}
+		hash = u.Query().Get("h")
+	} else if n := len(parts); n >= 2 && vimeoIDRE.MatchString(parts[n-2]) && !vimeoIDRE.MatchString(id) {
+		id, hash = parts[n-2], id
+	}
+	if !vimeoIDRE.MatchString(id) {
+		return nil, fmt.Errorf("no video ID in Vimeo URL %q", u)
+	}
+	if hash != "" && !vimeoHashRE.MatchString(hash) {
+		return nil, fmt.Errorf("bad unlisted video hash in Vimeo URL %q", u)
+	}
+	norm := "https://vimeo.com/" + id
+	if hash != "" {
+		norm += "/" + hash
+	}
+	return &Media{
+		URL:     mustParseURL(norm),
+		ID:      r.Name() + ":" + id,
+		Backend: BackendMedia,
+	}, nil
+}
+
+// isAudioFile returns whether u links to an audio file, which
+// directResolver downloads directly.
+func isAudioFile(u *url.URL) bool {
+	return audio.IsFile(u.Path)
+}
+
+// directResolver resolves links straight to audio files, on any host.
+type directResolver struct{}
+
+func (directResolver) Name() string { return "http" }
+
+func (r directResolver) Resolve(u *url.URL) (*Media, error) {
+	if !isAudioFile(u) {
+		return nil, fmt.Errorf("not an audio file: %q", u)
+	}
+	norm := *u
+	norm.Host = strings.ToLower(norm.Host)
+	norm.Fragment = ""
+	return &Media{
+		URL:     norm,
+		ID:      r.Name() + ":" + norm.Host + norm.EscapedPath(),
+		Backend: BackendHTTP,
+	}, nil
+}
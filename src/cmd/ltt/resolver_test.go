@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		url string
+		// id is the media ID, or empty if the URL cannot be resolved.
+		id string
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?t=42", "youtube:dQw4w9WgXcQ"},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://music.youtube.com/watch?v=dQw4w9WgXcQ&feature=share", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1m2s", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL0123456789", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?list=PL0123456789&v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com/embed/dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com/shorts/dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"HTTPS://WWW.YouTube.COM/watch?v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com./watch?v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ"},
+		{"https://www.youtube.com/playlist?list=PL0123456789", ""},
+		{"https://www.youtube.com/watch?v=short", ""},
+
+		{"https://artist.bandcamp.com/track/song", "bandcamp:artist/song"},
+		{"https://Artist.Bandcamp.com/track/song?from=discover", "bandcamp:artist/song"},
+		{"https://artist.bandcamp.com/album/record", ""},
+		{"https://artist.bandcamp.com/", ""},
+
+		{"https://soundcloud.com/Artist/Song", "soundcloud:artist/song"},
+		{"https://m.soundcloud.com/artist/song", "soundcloud:artist/song"},
+		{"https://soundcloud.com/artist/sets/record", ""},
+
+		{"https://vimeo.com/123456", "vimeo:123456"},
+		{"https://vimeo.com/channels/staffpicks/123456", "vimeo:123456"},
+		{"https://vimeo.com/123456/abcdef0123", "vimeo:123456"},
+		{"https://player.vimeo.com/video/123456?h=abcdef0123", "vimeo:123456"},
+		{"https://vimeo.com/artist", ""},
+
+		{"https://example.com/songs/Song.MP3", "http:example.com/songs/Song.MP3"},
+		{"https://EXAMPLE.com/song.ogg#t=10", "http:example.com/song.ogg"},
+		{"https://example.com/page", ""},
+		{"ftp://example.com/song.mp3", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Resolve(u)
+		switch {
+		case err != nil && tt.id != "":
+			t.Errorf("Resolve(%q): %v", tt.url, err)
+		case err == nil && m.ID != tt.id:
+			t.Errorf("Resolve(%q) = %q, want %q", tt.url, m.ID, tt.id)
+		}
+	}
+}
+
+func TestResolveVimeoUnlisted(t *testing.T) {
+	for _, s := range []string{
+		"https://vimeo.com/123456/abcdef0123",
+		"https://player.vimeo.com/video/123456?h=abcdef0123",
+	} {
+		u, _ := url.Parse(s)
+		m, err := Resolve(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The hash must survive, or the video cannot be downloaded.
+		if want := "https://vimeo.com/123456/abcdef0123"; m.URL.String() != want {
+			t.Errorf("Resolve(%q) URL = %q, want %q", s, m.URL.String(), want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The folders meh moves songs to, relative to the library.
+const (
+	keepDir  = "Keep"
+	trashDir = "Trash"
+)
+
+// RetentionPolicy limits the songs kept in the library that have not been
+// triaged into Keep/. Zero limits are no limit.
+type RetentionPolicy struct {
+	// MaxGB is the most space, in gigabytes, songs outside Keep/ take.
+	MaxGB float64 `json:"max_gb"`
+
+	// MaxAge is how long songs outside Keep/ are kept after they were
+	// downloaded.
+	MaxAge Duration `json:"max_age"`
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxGB > 0 || p.MaxAge.Duration > 0
+}
+
+// inFolder returns whether the file at rel, relative to the library, is in
+// the folder dir.
+func inFolder(rel, dir string) bool {
+	return strings.HasPrefix(rel, dir+"/")
+}
+
+// evictable is a download whose files may be evicted.
+type evictable struct {
+	dl *Download
+
+	// paths are where the files of dl are on disk, relative to the
+	// library, which for songs meh moved is not where they were recorded.
+	paths []string
+	size  int64
+	trash bool
+}
+
+// triage indexes the files in Keep/ and Trash/ by name. meh moves songs
+// there without telling the history.
+type triage map[string][]string
+
+func (l *Library) scanTriage() (triage, error) {
+	t := triage{}
+	for _, dir := range []string{keepDir, trashDir} {
+		root := filepath.Join(l.Path, dir)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				rel, err := l.relPath(path)
+				if err != nil {
+					return err
+				}
+				t[info.Name()] = append(t[info.Name()], rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// locate returns where f is on disk, relative to the library, and its
+// size: where it was recorded, or else a file of the same name and size in
+// Keep/ or Trash/. It returns the empty string if f is nowhere.
+func (l *Library) locate(t triage, f *File) (string, int64) {
+	if info, err := os.Stat(l.absPath(f)); err == nil {
+		return f.Path, info.Size()
+	}
+	for _, rel := range t[path.Base(f.Path)] {
+		info, err := os.Stat(filepath.Join(l.Path, filepath.FromSlash(rel)))
+		if err == nil && info.Size() == f.Size {
+			return rel, f.Size
+		}
+	}
+	return "", 0
+}
+
+// evictables returns the downloads with files on disk, none of which are
+// in Keep/: those in Trash/ first, as they were turned down, then the
+// oldest first.
+func (l *Library) evictables() ([]*evictable, error) {
+	dls, err := l.Downloads()
+	if err != nil {
+		return nil, err
+	}
+	t, err := l.scanTriage()
+	if err != nil {
+		return nil, err
+	}
+	var es []*evictable
+	for _, dl := range dls {
+		if dl.CurrentState() != StateDone || dl.Evicted != nil {
+			continue
+		}
+		e := &evictable{dl: dl}
+		kept := false
+		for _, f := range dl.allFiles() {
+			rel, size := l.locate(t, &f)
+			if rel == "" {
+				continue
+			}
+			// meh triages one file of a song, which goes for all of
+			// its formats.
+			kept = kept || inFolder(rel, keepDir)
+			e.trash = e.trash || inFolder(rel, trashDir)
+			e.paths = append(e.paths, rel)
+			e.size += size
+		}
+		if !kept && len(e.paths) > 0 {
+			es = append(es, e)
+		}
+	}
+	sort.SliceStable(es, func(i, j int) bool {
+		if es[i].trash != es[j].trash {
+			return es[i].trash
+		}
+		return es[i].dl.downloadedAt().Before(es[j].dl.downloadedAt())
+	})
+	return es, nil
+}
+
+// enforceRetention evicts the downloads that are over the limits of the
+// retention policy, and returns them. In a dry run, nothing is evicted.
+func (l *Library) enforceRetention(dryRun bool) ([]*Download, error) {
+	p := l.Retention
+	if !p.enabled() {
+		return nil, nil
+	}
+	es, err := l.evictables()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range es {
+		total += e.size
+	}
+	limit := int64(p.MaxGB * (1 << 30))
+	now := time.Now()
+
+	var evicted []*Download
+	for _, e := range es {
+		var reason string
+		switch {
+		case p.MaxAge.Duration > 0 && now.Sub(e.dl.downloadedAt()) > p.MaxAge.Duration:
+			reason = "older than " + p.MaxAge.String()
+		case p.MaxGB > 0 && total > limit:
+			reason = fmt.Sprintf("over %g GB", p.MaxGB)
+		default:
+			continue
+		}
+		if dryRun {
+			log.Printf("would evict %q (%s): %s", e.dl.ID, e.dl.Track, reason)
+		} else {
+			err = l.evict(e, now)
+			if err != nil {
+				log.Printf("failed to evict %q: %v", e.dl.ID, err)
+				continue
+			}
+			log.Printf("evicted %q (%s): %s", e.dl.ID, e.dl.Track, reason)
+		}
+		total -= e.size
+		evicted = append(evicted, e.dl)
+	}
+	return evicted, nil
+}
+
+// evict deletes the files of e, and records when. The download stays
+// done, so that it is not downloaded again.
+func (l *Library) evict(e *evictable, now time.Time) error {
+	dirs := map[string]bool{}
+	for _, rel := range e.paths {
+		path := filepath.Join(l.Path, filepath.FromSlash(rel))
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		l.removeEmptyDirs(dir)
+	}
+	dl := e.dl
+	dl.Files, dl.Cover, dl.Evicted = nil, nil, &now
+	return l.SaveFiles(dl)
+}
+
+// retain enforces the retention policy after a run, logging rather than
+// failing, as the run itself went fine.
+func (l *Library) retain() {
+	evicted, err := l.enforceRetention(false)
+	if err != nil {
+		log.Printf("failed to enforce the retention policy: %v", err)
+	} else if len(evicted) > 0 {
+		log.Printf("evicted %d songs to keep within the retention policy", len(evicted))
+	}
+}
+
+func runEvict(cfg *Config, args []string) error {
+	fs := newFlagSet("evict")
+	dryRun := fs.Bool("dry-run", false, "print what would be evicted without deleting anything")
+	fs.Parse(args)
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	if !lib.Retention.enabled() {
+		return fmt.Errorf("no retention policy is configured")
+	}
+	_, err = lib.enforceRetention(*dryRun)
+	return err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var failedBucket = []byte("failed")
+
+var (
+	// ErrDead is returned when queueing a download that has been given up
+	// on.
+	ErrDead = fmt.Errorf("given up after failing")
+
+	// ErrNotDue is returned when queueing a failed download before it is
+	// due for a retry.
+	ErrNotDue = fmt.Errorf("not due for a retry")
+)
+
+// RetryPolicy decides when failed downloads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts after which a download is
+	// given up on.
+	MaxAttempts int `json:"max_attempts"`
+
+	// Backoff is the wait before the first retry. It doubles with each
+	// attempt after that, up to MaxBackoff.
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 6,
+		Backoff:     Duration{time.Hour},
+		MaxBackoff:  Duration{7 * 24 * time.Hour},
+	}
+}
+
+// delay returns how long to wait after the given number of attempts.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	d := p.Backoff.Duration
+	for i := 1; i < attempts && d < p.MaxBackoff.Duration; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff.Duration {
+		d = p.MaxBackoff.Duration
+	}
+	return d
+}
+
+// FailedDownload tracks the retries of a download that failed.
+type FailedDownload struct {
+	ID       string
+	Error    string
+	Attempts int
+	First    time.Time
+	Last     time.Time
+
+	// Next is when the download is due for a retry.
+	Next time.Time
+
+	// Dead is set once the download has been given up on.
+	Dead bool
+}
+
+// permanentErrors are downloader messages that mean retrying is pointless.
+var permanentErrors = []string{
+	"video unavailable",
+	"this video is unavailable",
+	"this video is private",
+	"private video",
+	"has been removed",
+	"account associated with this video has been terminated",
+	"copyright claim",
+	"copyright grounds",
+	"unsupported url",
+	"404: not found",
+	"404 not found",
+}
+
+func isPermanent(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, perm := range permanentErrors {
+		if strings.Contains(msg, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func getFailure(tx *bolt.Tx, id string) (*FailedDownload, error) {
+	b := tx.Bucket(failedBucket)
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	var f FailedDownload
+	err := json.Unmarshal(v, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode failure of %q: %v", id, err)
+	}
+	return &f, nil
+}
+
+func putFailure(tx *bolt.Tx, f *FailedDownload) error {
+	b, err := tx.CreateBucketIfNotExists(failedBucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(f.ID), data)
+}
+
+// checkRetry returns an error if prev, the current record of a download,
+// is not to be queued again yet.
+func checkRetry(tx *bolt.Tx, prev *Download) error {
+	switch prev.CurrentState() {
+	case StateDead:
+		return ErrDead
+	case StateFailed:
+		f, err := getFailure(tx, prev.ID)
+		if err != nil {
+			return err
+		}
+		if f != nil && f.Next.After(time.Now()) {
+			return ErrNotDue
+		}
+	}
+	return nil
+}
+
+// recordFailure counts another failed attempt at dl, and schedules the
+// next one, or gives up.
+func (l *Library) recordFailure(tx *bolt.Tx, dl *Download, reason error) (*FailedDownload, error) {
+	f, err := getFailure(tx, dl.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if f == nil {
+		f = &FailedDownload{ID: dl.ID, First: now}
+	}
+	f.Attempts++
+	f.Last = now
+	f.Error = ""
+	if reason != nil {
+		f.Error = reason.Error()
+	}
+	f.Next = now.Add(l.Retry.delay(f.Attempts))
+	f.Dead = f.Attempts >= l.Retry.MaxAttempts || isPermanent(f.Error)
+	return f, putFailure(tx, f)
+}
+
+func clearFailure(tx *bolt.Tx, dl *Download) error {
+	b := tx.Bucket(failedBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(dl.ID))
+}
+
+// Failures returns the downloads in the retry queue, including those that
+// have been given up on.
+func (l *Library) Failures() ([]*FailedDownload, error) {
+	var fs []*FailedDownload
+	err := l.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(failedBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var f FailedDownload
+			err := json.Unmarshal(v, &f)
+			if err != nil {
+				return fmt.Errorf("failed to decode failure of %q: %v", k, err)
+			}
+			fs = append(fs, &f)
+			return nil
+		})
+	})
+	return fs, err
+}
+
+// DueRetries returns the failed downloads that are due for a retry.
+func (l *Library) DueRetries() ([]*Download, error) {
+	fs, err := l.Failures()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var dls []*Download
+	for _, f := range fs {
+		if f.Dead || f.Next.After(now) {
+			continue
+		}
+		dl, err := l.Record(f.ID)
+		if err != nil {
+			return nil, err
+		}
+		if dl != nil && dl.CurrentState() == StateFailed {
+			dls = append(dls, dl)
+		}
+	}
+	return dls, nil
+}
+
+// ForceRetry makes the failed or dead download id due for a retry now, and
+// returns it.
+func (l *Library) ForceRetry(id string) (*Download, error) {
+	var dl *Download
+	err := l.Update(func(tx *bolt.Tx) error {
+		f, err := getFailure(tx, id)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return fmt.Errorf("%q has not failed", id)
+		}
+		f.Next = time.Now()
+		f.Dead = false
+		err = putFailure(tx, f)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return fmt.Errorf("no record of %q", id)
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("no record of %q", id)
+		}
+		dl, err = decodeDownload([]byte(id), v)
+		if err != nil {
+			return err
+		}
+		if dl.CurrentState() == StateDead {
+			// Revive it, so that it can be queued.
+			dl.State = StateFailed
+			data, err := json.Marshal(dl)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(id), data)
+		}
+		return nil
+	})
+	return dl, err
+}
+
+// planRetries plans the failed downloads that are due for a retry, for a
+// dry run.
+func (p *poller) planRetries() {
+	dls, err := p.lib.DueRetries()
+	if err != nil {
+		log.Printf("failed to load retries: %v", err)
+		return
+	}
+	for _, dl := range dls {
+		p.addPlan(dl.Feed, dl, PlanRetry, dl.Error)
+	}
+}
+
+// submitRetries submits the failed downloads that are due for a retry.
+func (p *poller) submitRetries() {
+	dls, err := p.lib.DueRetries()
+	if err != nil {
+		log.Printf("failed to load retries: %v", err)
+		return
+	}
+	for _, dl := range dls {
+		p.pool.Submit(dl)
+	}
+}
+
+func runFailures(cfg *Config, args []string) error {
+	fs := newFlagSet("failures")
+	dead := fs.Bool("dead", false, "only list downloads that have been given up on")
+	fs.Parse(args)
+
+	lib, err := openReadOnlyLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	failures, err := lib.Failures()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tATTEMPTS\tNEXT\tERROR")
+	for _, f := range failures {
+		next := f.Next.Format("2006-01-02 15:04")
+		if f.Dead {
+			next = "dead"
+		} else if *dead {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", f.ID, f.Attempts, next, f.Error)
+	}
+	return w.Flush()
+}
+
+func runRetry(cfg *Config, args []string) error {
+	fs := newFlagSet("retry")
+	all := fs.Bool("all", false, "retry every failed download now, even those given up on")
+	fs.Parse(args)
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	ids := fs.Args()
+	if *all {
+		failures, err := lib.Failures()
+		if err != nil {
+			return err
+		}
+		for _, f := range failures {
+			ids = append(ids, f.ID)
+		}
+	}
+
+	p := newPoller(lib, cfg)
+	if len(ids) == 0 {
+		// Just the ones that are due.
+		p.submitRetries()
+	}
+	for _, id := range ids {
+		dl, err := lib.ForceRetry(id)
+		if err != nil {
+			return err
+		}
+		p.pool.Submit(dl)
+	}
+	summary := p.pool.Wait()
+	fmt.Println(summary)
+	lib.retain()
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// State is where a download is in its lifecycle:
+//
+//	queued -> downloading -> done
+//	       |              -> failed -> dead
+//	       -> linked
+//	skipped
+//
+// Skipped downloads may be queued again, and failed downloads once they are
+// due for a retry. Done and dead downloads are never downloaded again,
+// unless a retry is forced. Linked downloads are reposts of media that was
+// already downloaded from another post.
+type State string
+
+const (
+	StateQueued      State = "queued"
+	StateDownloading State = "downloading"
+	StateDone        State = "done"
+	StateFailed      State = "failed"
+	StateSkipped     State = "skipped"
+	StateDead        State = "dead"
+	StateLinked      State = "linked"
+)
+
+// ErrAlreadyDownloaded is returned when queueing or archiving a download
+// that is already done.
+var ErrAlreadyDownloaded = fmt.Errorf("already downloaded")
+
+// CurrentState returns the state of dl. Records from before states were
+// kept are all done.
+func (dl *Download) CurrentState() State {
+	if dl.State == "" {
+		return StateDone
+	}
+	return dl.State
+}
+
+func decodeDownload(k, v []byte) (*Download, error) {
+	var dl Download
+	err := json.Unmarshal(v, &dl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %v", k, err)
+	}
+	if dl.Track.Title == "" && dl.Track.Artist == "" {
+		// Recorded before titles were parsed.
+		dl.Track = ParseTitle(dl.Title)
+	}
+	dl.resolveMediaID()
+	return &dl, nil
+}
+
+// Record returns the history record of id, or nil if there is none.
+func (l *Library) Record(id string) (*Download, error) {
+	var dl *Download
+	err := l.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var err error
+		dl, err = decodeDownload([]byte(id), v)
+		return err
+	})
+	return dl, err
+}
+
+// transition moves dl to state in the history, in a transaction of its
+// own, recording reason if it is not nil. It fails with
+// ErrAlreadyDownloaded if the history has dl done, unless dl is the one
+// that is done. Queueing also fails with ErrDead or ErrNotDue if dl has
+// failed and is not due for a retry, or ErrInProgress if its media is being
+// downloaded from another post. If its media was already downloaded from
+// another post, dl is linked to that post and ErrRepost is returned.
+//
+// A failure is recorded in the retry queue, and becomes dead once it is
+// not worth retrying.
+func (l *Library) transition(dl *Download, state State, reason error) error {
+	linked := false
+	err := l.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(downloadedBucket)
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(dl.ID)); v != nil && state != StateDone && state != StateQueued {
+			prev, err := decodeDownload([]byte(dl.ID), v)
+			if err != nil {
+				return err
+			}
+			switch prev.CurrentState() {
+			case StateDone:
+				return ErrAlreadyDownloaded
+			case StateLinked:
+				return ErrRepost
+			}
+		}
+
+		switch state {
+		case StateQueued:
+			_, orig, err := l.decide(tx, dl)
+			if err != nil {
+				return err
+			}
+			if orig != nil {
+				dl.Original = orig.ID
+				state = StateLinked
+				linked = true
+			} else {
+				err = indexMedia(tx, dl)
+				if err != nil {
+					return err
+				}
+			}
+		case StateFailed:
+			f, err := l.recordFailure(tx, dl, reason)
+			if err != nil {
+				return err
+			}
+			if f.Dead {
+				state = StateDead
+			}
+		case StateDone:
+			if dl.Downloaded == nil {
+				now := time.Now()
+				dl.Downloaded = &now
+			}
+			err = clearFailure(tx, dl)
+			if err != nil {
+				return err
+			}
+			err = indexMedia(tx, dl)
+			if err != nil {
+				return err
+			}
+		}
+
+		dl.State = state
+		dl.Updated = time.Now()
+		dl.Error = ""
+		if reason != nil {
+			dl.Error = reason.Error()
+		}
+		data, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, b, dl, data)
+	})
+	if err == nil && linked {
+		return ErrRepost
+	}
+	return err
+}
+
+// Queue records dl as queued for download, without touching the network.
+// It fails if dl is not to be downloaded; see transition.
+func (l *Library) Queue(dl *Download) error {
+	return l.transition(dl, StateQueued, nil)
+}
+
+// errInterrupted is the failure recorded for downloads that ltt stopped or
+// crashed in the middle of.
+var errInterrupted = fmt.Errorf("interrupted")
+
+// Unqueue undoes Queue for dl, when it is not going to be downloaded after
+// all: a retried failure is failed again, due as it was, and a new download
+// is forgotten, so that the next run queues it again.
+func (l *Library) Unqueue(dl *Download) error {
+	return l.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return nil
+		}
+		prev, err := getRecord(b, dl.ID)
+		if err != nil || prev == nil || prev.CurrentState() != StateQueued {
+			return err
+		}
+		f, err := getFailure(tx, dl.ID)
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			prev.State, prev.Error = StateFailed, f.Error
+			data, err := json.Marshal(prev)
+			if err != nil {
+				return err
+			}
+			return putRecord(tx, b, prev, data)
+		}
+		if idx := tx.Bucket(mediaBucket); idx != nil && prev.MediaID != "" &&
+			string(idx.Get([]byte(prev.MediaID))) == prev.ID {
+			err = idx.Delete([]byte(prev.MediaID))
+			if err != nil {
+				return err
+			}
+		}
+		return b.Delete([]byte(dl.ID))
+	})
+}
+
+// recoverInterrupted fails the downloads left queued or downloading by an
+// ltt that was stopped or crashed, due for a retry now. Otherwise they
+// would hold up other posts of the same media for good.
+func (l *Library) recoverInterrupted() error {
+	return l.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(downloadedBucket)
+		if b == nil {
+			return nil
+		}
+		var stuck []*Download
+		err := b.ForEach(func(k, v []byte) error {
+			dl, err := decodeDownload(k, v)
+			if err != nil {
+				return err
+			}
+			if s := dl.CurrentState(); s == StateQueued || s == StateDownloading {
+				stuck = append(stuck, dl)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, dl := range stuck {
+			err = markInterrupted(tx, b, dl)
+			if err != nil {
+				return err
+			}
+		}
+		if len(stuck) > 0 {
+			log.Printf("%d interrupted downloads will be retried", len(stuck))
+		}
+		return nil
+	})
+}
+
+// interrupt records that dl was interrupted by ltt stopping, so that it is
+// retried on the next run.
+func (l *Library) interrupt(dl *Download) error {
+	return l.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(downloadedBucket)
+		if err != nil {
+			return err
+		}
+		return markInterrupted(tx, b, dl)
+	})
+}
+
+// markInterrupted fails dl as interrupted, due for a retry now.
+func markInterrupted(tx *bolt.Tx, b *bolt.Bucket, dl *Download) error {
+	now := time.Now()
+	f, err := getFailure(tx, dl.ID)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		f = &FailedDownload{ID: dl.ID, First: now}
+	}
+	// Not an attempt that failed, so not counted as one.
+	f.Error, f.Last, f.Next, f.Dead = errInterrupted.Error(), now, now, false
+	err = putFailure(tx, f)
+	if err != nil {
+		return err
+	}
+	dl.State, dl.Error, dl.Updated = StateFailed, f.Error, now
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return putRecord(tx, b, dl, data)
+}
+
+// Skip records that dl was not downloaded, and why.
+func (l *Library) Skip(dl *Download, reason error) error {
+	prev, err := l.Record(dl.ID)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.State == StateSkipped && prev.Error == reason.Error() {
+		// Feeds are polled over and over; don't rewrite the same
+		// record each time.
+		return nil
+	}
+	return l.transition(dl, StateSkipped, reason)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Subscription is a subreddit feed that ltt follows.
+type Subscription struct {
+	// Name identifies the subscription in logs and on the command line.
+	// Defaults to the last element of Path.
+	Name string `json:"name,omitempty"`
+
+	// Path is the subreddit path, such as "r/listentothis".
+	Path string `json:"path"`
+
+	// Query is appended to the feed URL, such as "?sort=top&t=week".
+	Query string `json:"query,omitempty"`
+
+	// Folder is the directory, relative to the library, that songs from
+	// this subscription are downloaded into. Defaults to the library itself.
+	Folder string `json:"folder,omitempty"`
+
+	// Interval is how often 'ltt daemon' polls this feed. Defaults to the
+	// interval in the config.
+	Interval *Duration `json:"interval,omitempty"`
+
+	// Rules decide which posts from this subscription are downloaded,
+	// after the rules in the config.
+	Rules
+}
+
+// DisplayName returns the subscription name.
+func (s *Subscription) DisplayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return path.Base(strings.Trim(s.Path, "/"))
+}
+
+// URL returns the RSS feed URL.
+func (s *Subscription) URL() string {
+	return "https://www.reddit.com/" + strings.Trim(s.Path, "/") + "/.rss" + s.Query
+}
+
+func (s *Subscription) validate() error {
+	if strings.Trim(s.Path, "/") == "" {
+		return fmt.Errorf("missing path")
+	}
+	err := checkFolder(s.Folder)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.DisplayName(), err)
+	}
+	err = s.Rules.compile()
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.DisplayName(), err)
+	}
+	return nil
+}
+
+// checkFolder returns an error if folder is not a relative path inside the
+// library.
+func checkFolder(folder string) error {
+	clean := filepath.Clean(folder)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("folder %q must be inside the library", folder)
+	}
+	return nil
+}
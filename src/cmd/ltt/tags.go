@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Tags are the metadata written into downloaded files. They are kept as
+// Vorbis comment fields, such as ARTIST, which each format maps to its
+// own.
+type Tags struct {
+	fields []tagField
+
+	// Cover is the front cover to embed, if any.
+	Cover *Picture
+}
+
+type tagField struct {
+	name, value string
+}
+
+// Add adds a field, unless value is empty. A name may be added more than
+// once, as with several genres.
+func (t *Tags) Add(name, value string) {
+	if value == "" {
+		return
+	}
+	t.fields = append(t.fields, tagField{strings.ToUpper(name), value})
+}
+
+func (t *Tags) clone() *Tags {
+	c := *t
+	c.fields = append([]tagField(nil), t.fields...)
+	return &c
+}
+
+// comments returns the fields as Vorbis comments, "NAME=value".
+func (t *Tags) comments() []string {
+	var comments []string
+	for _, f := range t.fields {
+		comments = append(comments, f.name+"="+f.value)
+	}
+	return comments
+}
+
+// merge returns old Vorbis comments with the fields of t, and extra, in
+// place of any with the same names.
+func (t *Tags) merge(old []string, extra ...tagField) []string {
+	set := map[string]bool{}
+	for _, f := range t.fields {
+		set[f.name] = true
+	}
+	for _, f := range extra {
+		set[f.name] = true
+	}
+	var comments []string
+	for _, c := range old {
+		name := c
+		if i := strings.Index(c, "="); i >= 0 {
+			name = c[:i]
+		}
+		if !set[strings.ToUpper(name)] {
+			comments = append(comments, c)
+		}
+	}
+	comments = append(comments, t.comments()...)
+	for _, f := range extra {
+		comments = append(comments, f.name+"="+f.value)
+	}
+	return comments
+}
+
+// downloadTags returns the tags for the files of dl: the parsed post title,
+// with the post's permalink as a comment and the media URL.
+func downloadTags(dl *Download) *Tags {
+	t := &Tags{}
+	track := dl.Track
+	t.Add("ARTIST", track.Artist)
+	if track.Title != "" {
+		t.Add("TITLE", track.Title)
+	} else {
+		t.Add("TITLE", dl.Title)
+	}
+	for _, g := range track.Genres {
+		t.Add("GENRE", g)
+	}
+	if track.Year != 0 {
+		t.Add("DATE", strconv.Itoa(track.Year))
+	}
+	media := dl.URL.String()
+	if dl.Link != media {
+		// Songs added by hand have no post to link to.
+		t.Add("COMMENT", dl.Link)
+	}
+	t.Add("URL", media)
+	return t
+}
+
+// errUntaggable is returned when tagging files of a format ltt cannot tag.
+var errUntaggable = fmt.Errorf("cannot tag files of this format")
+
+// writeTags writes tags into the audio file at path: as Vorbis comments in
+// Ogg Vorbis, Opus and FLAC files, and as an ID3v2 tag in MP3 files. The
+// cover goes wherever each format keeps pictures.
+func writeTags(path string, tags *Tags) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ogg", ".oga", ".opus":
+		return writeOggTags(path, tags)
+	case ".flac":
+		return writeFLACTags(path, tags)
+	case ".mp3":
+		return writeID3Tags(path, tags)
+	}
+	return errUntaggable
+}
+
+// readTags reads the tags of the audio file at path, as writeTags writes
+// them. Files of other formats have none.
+func readTags(path string) (*Tags, error) {
+	var comments []string
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ogg", ".oga", ".opus":
+		comments, err = readOggTags(path)
+	case ".flac":
+		comments, err = readFLACTags(path)
+	case ".mp3":
+		comments, err = readID3Tags(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &Tags{}
+	for _, c := range comments {
+		if i := strings.Index(c, "="); i > 0 {
+			t.Add(c[:i], c[i+1:])
+		}
+	}
+	return t, nil
+}
+
+// Get returns the first value of the field name, or the empty string.
+func (t *Tags) Get(name string) string {
+	if v := t.Values(name); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Values returns the values of the field name.
+func (t *Tags) Values(name string) []string {
+	name = strings.ToUpper(name)
+	var values []string
+	for _, f := range t.fields {
+		if f.name == name {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Track is the song metadata parsed from a post title.
+type Track struct {
+	Artist string   `json:",omitempty"`
+	Title  string   `json:",omitempty"`
+	Genres []string `json:",omitempty"`
+	Year   int      `json:",omitempty"`
+
+	// Notes is whatever else followed the genre and year, such as
+	// "(live at KEXP)" or "first single in a decade".
+	Notes string `json:",omitempty"`
+}
+
+// String returns "Artist - Title", or whichever of the two is known.
+func (t Track) String() string {
+	switch {
+	case t.Artist != "" && t.Title != "":
+		return t.Artist + " - " + t.Title
+	case t.Title != "":
+		return t.Title
+	default:
+		return t.Artist
+	}
+}
+
+// Genre returns the first genre, or the empty string if there is none.
+func (t Track) Genre() string {
+	if len(t.Genres) == 0 {
+		return ""
+	}
+	return t.Genres[0]
+}
+
+// artistSeparators split the artist from the song title, in order of
+// preference. /r/listentothis asks for "--", but posters make do with
+// whatever dash their keyboard gives them.
+var artistSeparators = []string{"--", " — ", " – ", "—", "–", " - "}
+
+// separatorChars are what the artist separators are made of.
+const separatorChars = " -—–"
+
+var (
+	genreRE = regexp.MustCompile(`\[([^\]]*)\]`)
+	yearRE  = regexp.MustCompile(`[(\[]\s*((?:19|20)\d\d)\b[^)\]]*[)\]]`)
+)
+
+// ParseTitle parses a post title following the /r/listentothis convention
+// of "Artist -- Title [Genre/Subgenre] (Year)". Any part may be missing, and
+// whatever does not fit is kept in Notes.
+func ParseTitle(s string) Track {
+	var t Track
+	s = strings.TrimSpace(s)
+
+	rest := s
+	for _, sep := range artistSeparators {
+		if i := strings.Index(s, sep); i > 0 {
+			t.Artist = strings.TrimSpace(s[:i])
+			rest = s[i+len(sep):]
+			break
+		}
+	}
+
+	// The song title runs up to the genre or year, whichever comes first.
+	end := len(rest)
+	var genre []int
+	for _, m := range genreRE.FindAllStringSubmatchIndex(rest, -1) {
+		if !isYear(rest[m[2]:m[3]]) {
+			genre = m
+			break
+		}
+	}
+	year := yearRE.FindStringSubmatchIndex(rest)
+	if year != nil && genre != nil && year[0] >= genre[0] && year[1] <= genre[1] {
+		// A genre that happens to start with a year, such as
+		// "[1990 Hip-Hop]", is still a genre.
+		year = nil
+	}
+	if genre != nil && genre[0] < end {
+		end = genre[0]
+	}
+	if year != nil && year[0] < end {
+		end = year[0]
+	}
+	// Trim the separators left around a title with no artist, as in
+	// "-- Song", or with a dash before the genre.
+	t.Title = strings.Trim(rest[:end], separatorChars)
+
+	if genre != nil {
+		t.Genres = splitGenres(rest[genre[2]:genre[3]])
+	}
+	if year != nil {
+		t.Year, _ = strconv.Atoi(rest[year[2]:year[3]])
+	}
+
+	// Notes are what is left after taking out the genre and year.
+	var notes []string
+	pos := end
+	for _, span := range sortedSpans(genre, year) {
+		if span[0] > pos {
+			notes = append(notes, rest[pos:span[0]])
+		}
+		if span[1] > pos {
+			pos = span[1]
+		}
+	}
+	notes = append(notes, rest[pos:])
+	t.Notes = strings.Join(strings.Fields(strings.Join(notes, " ")), " ")
+	return t
+}
+
+func isYear(s string) bool {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	return err == nil && n >= 1900 && n < 2100
+}
+
+// splitGenres splits a genre list such as "Indie Rock/Folk, Americana".
+func splitGenres(s string) []string {
+	var genres []string
+	seen := map[string]bool{}
+	for _, g := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == '/' || r == ',' || r == '|' || r == ';'
+	}) {
+		g = strings.TrimSpace(g)
+		if g == "" || seen[strings.ToLower(g)] {
+			continue
+		}
+		seen[strings.ToLower(g)] = true
+		genres = append(genres, g)
+	}
+	return genres
+}
+
+// sortedSpans returns the non-nil match spans in order of position.
+func sortedSpans(a, b []int) [][]int {
+	var spans [][]int
+	if a != nil {
+		spans = append(spans, a[:2])
+	}
+	if b != nil {
+		spans = append(spans, b[:2])
+	}
+	if len(spans) == 2 && spans[1][0] < spans[0][0] {
+		spans[0], spans[1] = spans[1], spans[0]
+	}
+	return spans
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		want  Track
+	}{
+		{"Artist -- Song [Indie Rock/Folk] (2019)",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Indie Rock", "Folk"}, Year: 2019}},
+		{"Artist – Song [Jazz]",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Jazz"}}},
+		{"Artist—Song [Jazz]",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Jazz"}}},
+		{"Artist - Song [Jazz]",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Jazz"}}},
+		// A hyphen without spaces is part of the name.
+		{"Jay-Z -- Song-Title [Hip-Hop]",
+			Track{Artist: "Jay-Z", Title: "Song-Title", Genres: []string{"Hip-Hop"}}},
+		{"-- Song [Jazz]",
+			Track{Title: "Song", Genres: []string{"Jazz"}}},
+		{"Song [Jazz]",
+			Track{Title: "Song", Genres: []string{"Jazz"}}},
+		{"Artist -- Song (1971)",
+			Track{Artist: "Artist", Title: "Song", Year: 1971}},
+		{"Artist -- Song - [Jazz]",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Jazz"}}},
+		{"Artist -- Song [Soul] [1971]",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Soul"}, Year: 1971}},
+		{"Artist -- Song [1990 Hip-Hop]",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"1990 Hip-Hop"}}},
+		{"Artist -- Song [Folk] (1968) live at KEXP",
+			Track{Artist: "Artist", Title: "Song", Genres: []string{"Folk"}, Year: 1968, Notes: "live at KEXP"}},
+	}
+	for _, tt := range tests {
+		if got := ParseTitle(tt.title); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTitle(%q) = %+v, want %+v", tt.title, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Profile is a way of encoding downloaded audio for the library. Each
+// download is made into one file per output profile, by ffmpeg, so that
+// one download can give both an archival copy and a small one for a phone.
+type Profile struct {
+	// Name is the key of the profile in the config.
+	Name string `json:"-"`
+
+	// Codec is the audio codec: "vorbis", "opus", "mp3", "aac" or
+	// "flac". If it is empty, the downloaded audio is kept as it is.
+	// Audio that is already in the codec is not encoded again.
+	Codec string `json:"codec,omitempty"`
+
+	// Bitrate is the target bitrate, such as "128k".
+	Bitrate string `json:"bitrate,omitempty"`
+
+	// Quality is the variable bitrate quality, in the encoder's own
+	// scale, such as "0" for mp3 V0.
+	Quality string `json:"quality,omitempty"`
+
+	// LosslessOnly only encodes audio that is lossless to begin with.
+	// Anything else is kept as it is, rather than making a bigger file
+	// that is no better.
+	LosslessOnly bool `json:"lossless_only,omitempty"`
+
+	// Folder is the directory, relative to the download's folder, the
+	// files go in.
+	Folder string `json:"folder,omitempty"`
+
+	// Args are extra ffmpeg output options, such as ["-ac", "1"].
+	Args []string `json:"args,omitempty"`
+}
+
+// codec is how ffmpeg encodes a codec, and the file it goes in.
+type codec struct {
+	encoder, muxer, ext string
+}
+
+var codecs = map[string]codec{
+	"vorbis": {"libvorbis", "ogg", ".ogg"},
+	"opus":   {"libopus", "ogg", ".opus"},
+	"mp3":    {"libmp3lame", "mp3", ".mp3"},
+	"aac":    {"aac", "ipod", ".m4a"},
+	"flac":   {"flac", "flac", ".flac"},
+}
+
+func builtinProfiles() map[string]*Profile {
+	return map[string]*Profile{
+		"original": {},
+		"vorbis":   {Codec: "vorbis", Quality: "5"},
+		"opus":     {Codec: "opus", Bitrate: "128k"},
+		"mp3":      {Codec: "mp3", Quality: "0"},
+		"flac":     {Codec: "flac", LosslessOnly: true},
+	}
+}
+
+func (p *Profile) validate() error {
+	if _, ok := codecs[p.Codec]; !ok && p.Codec != "" {
+		return fmt.Errorf("profile %q: unknown codec %q", p.Name, p.Codec)
+	}
+	err := checkFolder(p.Folder)
+	if err != nil {
+		return fmt.Errorf("profile %q: %v", p.Name, err)
+	}
+	return nil
+}
+
+// folder returns the folder of p, which may be nil.
+func (p *Profile) folder() string {
+	if p == nil {
+		return ""
+	}
+	return p.Folder
+}
+
+// keeps returns whether p keeps a file with the given codec and extension
+// as it is.
+func (p *Profile) keeps(srcCodec, srcExt string) bool {
+	if p.Codec == "" || p.LosslessOnly && !isLossless(srcCodec) {
+		return true
+	}
+	return p.Codec == srcCodec && codecs[p.Codec].ext == strings.ToLower(srcExt)
+}
+
+func isLossless(codec string) bool {
+	switch codec {
+	case "flac", "alac", "wavpack", "ape", "tta":
+		return true
+	}
+	return strings.HasPrefix(codec, "pcm_")
+}
+
+// probeCodec returns the codec of the first audio stream in path, as
+// ffprobe names it.
+func probeCodec(path string) (string, error) {
+	out, err := childOutput(childCommand("ffprobe", "-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name",
+		"-of", "default=noprint_wrappers=1:nokey=1", path))
+	if err != nil {
+		return "", err
+	}
+	codec := strings.TrimSpace(string(out))
+	if codec == "" {
+		return "", fmt.Errorf("no audio in %q", path)
+	}
+	return codec, nil
+}
+
+// output is a file made for an output profile.
+type output struct {
+	path    string
+	profile *Profile
+}
+
+// transcode makes the files for the library's output profiles from the
+// files a downloader wrote, which are removed unless a profile keeps them.
+// With no output profiles, the downloaded files are kept as they are.
+func (l *Library) transcode(dl *Download, sources []string) ([]output, error) {
+	var outs []output
+	if len(l.Outputs) == 0 {
+		for _, src := range sources {
+			outs = append(outs, output{path: src})
+		}
+		return outs, nil
+	}
+	for _, src := range sources {
+		made, err := l.transcodeFile(dl, src)
+		if err != nil {
+			for _, out := range outs {
+				os.Remove(out.path)
+			}
+			return nil, err
+		}
+		outs = append(outs, made...)
+	}
+	return outs, nil
+}
+
+func (l *Library) transcodeFile(dl *Download, src string) (outs []output, err error) {
+	defer func() {
+		if err != nil {
+			for _, out := range outs {
+				os.Remove(out.path)
+			}
+			outs = nil
+		}
+	}()
+
+	srcCodec, err := probeCodec(src)
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(src)
+	stem := strings.TrimSuffix(filepath.Base(src), ext)
+
+	// Encode first, since keeping the source may move it.
+	var keeps []*Profile
+	for _, p := range l.Outputs {
+		if p.keeps(srcCodec, ext) {
+			keeps = append(keeps, p)
+			continue
+		}
+		c := codecs[p.Codec]
+		dest := filepath.Join(filepath.Dir(src), filepath.FromSlash(p.Folder), stem+c.ext)
+		dest, err = l.freePath(dl, "", dest)
+		if err != nil {
+			return outs, err
+		}
+		err = encode(src, dest, p, p.Codec == srcCodec)
+		if err != nil {
+			return outs, fmt.Errorf("profile %q: %v", p.Name, err)
+		}
+		outs = append(outs, output{dest, p})
+	}
+
+	if len(keeps) == 0 {
+		return outs, os.Remove(src)
+	}
+	kept := ""
+	keptIn := map[string]bool{}
+	for _, p := range keeps {
+		if keptIn[p.Folder] {
+			// Another profile already keeps the same file here.
+			continue
+		}
+		keptIn[p.Folder] = true
+		dest := filepath.Join(filepath.Dir(src), filepath.FromSlash(p.Folder), filepath.Base(src))
+		from := src
+		if kept != "" {
+			from = ""
+		}
+		dest, err = l.freePath(dl, from, dest)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(dest), 0755)
+		}
+		if err != nil {
+			return outs, err
+		}
+		if kept == "" {
+			if dest != src {
+				err = os.Rename(src, dest)
+			}
+			kept = dest
+		} else {
+			err = copyFile(kept, dest)
+		}
+		if err != nil {
+			return outs, err
+		}
+		outs = append(outs, output{dest, p})
+	}
+	return outs, nil
+}
+
+// encode encodes the audio of src into dest as p says. If remux is set, the
+// audio is already in the right codec and is only put in a new container.
+func encode(src, dest string, p *Profile, remux bool) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	c := codecs[p.Codec]
+	args := []string{"-nostdin", "-v", "error", "-y", "-i", src, "-vn", "-map", "0:a:0"}
+	if remux {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", c.encoder)
+		if p.Bitrate != "" {
+			args = append(args, "-b:a", p.Bitrate)
+		}
+		if p.Quality != "" {
+			args = append(args, "-q:a", p.Quality)
+		}
+	}
+	args = append(args, p.Args...)
+	// Encode to a .part file, like the downloaders, so that an
+	// interrupted encode is not mistaken for a song.
+	part := dest + ".part"
+	args = append(args, "-f", c.muxer, part)
+
+	var stderr bytes.Buffer
+	cmd := childCommand("ffmpeg", args...)
+	cmd.Stderr = &stderr
+	err = runChild(cmd)
+	if err != nil {
+		os.Remove(part)
+		if msg := lastLine(stderr.String()); msg != "" {
+			return fmt.Errorf("ffmpeg: %v: %s", err, msg)
+		}
+		return fmt.Errorf("ffmpeg: %v", err)
+	}
+	return os.Rename(part, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
@@ -6,10 +6,15 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"audio"
+
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -58,19 +63,22 @@ func main() {
 
 	r := httprouter.New()
 	r.GET("/", s.index)
-	r.GET("/song/:filename", s.index)
-	r.POST("/song/:filename", s.keep)
-	r.DELETE("/song/:filename", s.trash)
+	r.GET("/song/*filename", s.index)
+	r.POST("/song/*filename", s.keep)
+	r.DELETE("/song/*filename", s.trash)
 	r.ServeFiles("/files/*filepath", http.Dir(s.path))
 
 	log.Fatal(http.ListenAndServe("127.0.0.1:8080", r))
 }
 
-func (*service) index(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
-	var err error
-	filename := p.ByName("filename")
+func (s *service) index(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	filename, err := s.songPath(p.ByName("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if filename == "" {
-		filename, err = randomFilename()
+		filename, err = s.randomFilename()
 		if err == ErrNotFound {
 			// TODO: react gracefully here
 			http.Error(w, "no files found", http.StatusNotFound)
@@ -83,8 +91,14 @@ func (*service) index(w http.ResponseWriter, req *http.Request, p httprouter.Par
 
 	err = playTemplate.Execute(w, struct {
 		Filename string
+		Path     string
+		Format   string
+		Cover    string
 	}{
 		Filename: filename,
+		Path:     escapePath(filename),
+		Format:   playerFormat(filename),
+		Cover:    escapePath(s.coverFilename(filename)),
 	})
 	if err != nil {
 		http.Error(w, "failed to execute template", http.StatusInternalServerError)
@@ -93,8 +107,33 @@ func (*service) index(w http.ResponseWriter, req *http.Request, p httprouter.Par
 
 var ErrNotFound = fmt.Errorf("not found")
 
-func randomFilename() (string, error) {
-	matches, err := filepath.Glob(filepath.Join(defaultPath(), "*.ogg"))
+// randomFilename picks a song anywhere in the library, as ltt's naming
+// template may put them in folders, except for those already in Keep/ or
+// Trash/. It returns the path relative to the library, with slashes.
+func (s *service) randomFilename() (string, error) {
+	var matches []string
+	err := filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// ltt's history and quarantine are hidden.
+			if path == s.keepDir() || path == s.trashDir() ||
+				(path != s.path && strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !audio.IsFile(filepath.ToSlash(path)) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.path, path)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, filepath.ToSlash(rel))
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
@@ -102,17 +141,75 @@ func randomFilename() (string, error) {
 		return "", ErrNotFound
 	}
 	n := rand.Intn(len(matches))
-	return filepath.Base(matches[n]), nil
+	return matches[n], nil
+}
+
+// songPath checks the path of a song from a request, relative to the
+// library, and returns it cleaned. Songs already in Keep/ or Trash/, or
+// outside the library, are refused.
+func (s *service) songPath(param string) (string, error) {
+	filename := strings.TrimPrefix(param, "/")
+	if filename == "" {
+		return "", nil
+	}
+	filename = path.Clean(filename)
+	if filename == ".." || strings.HasPrefix(filename, "../") {
+		return "", fmt.Errorf("%q is outside the library", param)
+	}
+	for _, dir := range []string{"Keep", "Trash"} {
+		if strings.HasPrefix(filename, dir+"/") {
+			return "", fmt.Errorf("%q is already in %s", filename, dir)
+		}
+	}
+	return filename, nil
+}
+
+// escapePath escapes each element of the relative path p for use in a URL.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// playerFormat returns the jPlayer media format of filename.
+func playerFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".mp3":
+		return "mp3"
+	case ".m4a":
+		return "m4a"
+	case ".flac":
+		return "flac"
+	case ".wav":
+		return "wav"
+	}
+	return "oga"
+}
+
+// coverFilename returns the name of the cover art ltt saved next to the
+// song filename, or the empty string if there is none.
+func (s *service) coverFilename(filename string) string {
+	cover := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpg"
+	if _, err := os.Stat(filepath.Join(s.path, filepath.FromSlash(cover))); err != nil {
+		return ""
+	}
+	return cover
 }
 
 func (s *service) keep(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
-	filename := p.ByName("filename")
+	filename, err := s.songPath(p.ByName("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if filename == "" {
 		http.Error(w, "missing required filename parameter", http.StatusBadRequest)
 		return
 	}
 
-	err := s.moveFile(filename, s.keepDir())
+	err = s.moveFile(filename, s.keepDir())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, fmt.Sprintf("failed to rename song file: %v", err), http.StatusInternalServerError)
@@ -121,13 +218,17 @@ func (s *service) keep(w http.ResponseWriter, req *http.Request, p httprouter.Pa
 }
 
 func (s *service) trash(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
-	filename := p.ByName("filename")
+	filename, err := s.songPath(p.ByName("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if filename == "" {
 		http.Error(w, "missing required filename parameter", http.StatusBadRequest)
 		return
 	}
 
-	err := s.moveFile(filename, s.trashDir())
+	err = s.moveFile(filename, s.trashDir())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, fmt.Sprintf("failed to rename song file: %v", err), http.StatusInternalServerError)
@@ -135,10 +236,41 @@ func (s *service) trash(w http.ResponseWriter, req *http.Request, p httprouter.P
 	}
 }
 
+// moveFile moves the song at filename, relative to the library, into the
+// same folders under newPath, so that songs with the same name in
+// different folders do not clash.
 func (s *service) moveFile(filename, newPath string) error {
-	oldpath := filepath.Join(s.path, filename)
-	newpath := filepath.Join(newPath, filename)
-	return os.Rename(oldpath, newpath)
+	dir := filepath.Dir(filepath.Join(newPath, filepath.FromSlash(filename)))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	// The cover goes along with the song.
+	if cover := s.coverFilename(filename); cover != "" {
+		err := os.Rename(filepath.Join(s.path, filepath.FromSlash(cover)), filepath.Join(newPath, filepath.FromSlash(cover)))
+		if err != nil {
+			return err
+		}
+	}
+	oldpath := filepath.Join(s.path, filepath.FromSlash(filename))
+	newpath := filepath.Join(newPath, filepath.FromSlash(filename))
+	err = os.Rename(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	s.removeEmptyDirs(filepath.Dir(oldpath))
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents, up to but not including the
+// library, for as long as they are empty.
+func (s *service) removeEmptyDirs(dir string) {
+	for dir != s.path && strings.HasPrefix(dir, s.path) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
 }
 
 // TODO: make this all fancy and shit
@@ -153,6 +285,7 @@ var playTemplate = template.Must(template.New("play").Parse(`<html>
 </head>
 <body>
 <h1>{{ .Filename }}</h1>
+{{ if .Cover }}<img src="/files/{{ .Cover }}" width="300" height="300" alt="">{{ end }}
 
 <script type="text/javascript">
 //<![CDATA[
@@ -164,7 +297,7 @@ next = function(){
 keep = function(){
 	$.ajax({
 		type: "POST",
-		url: "/song/{{ .Filename }}",
+		url: "/song/{{ .Path }}",
 	}).done(function(){
 		next();
 	})
@@ -173,7 +306,7 @@ keep = function(){
 trash = function(){
 	$.ajax({
 		type: "DELETE",
-		url: "/song/{{ .Filename }}",
+		url: "/song/{{ .Path }}",
 	}).done(function(){
 		next();
 	})
@@ -185,13 +318,13 @@ $(document).ready(function(){
 		ready: function (event) {
 			$(this).jPlayer("setMedia", {
 				title: "{{ .Filename }}",
-				oga: "/files/{{ .Filename }}"
+				{{ .Format }}: "/files/{{ .Path }}"
 			}).jPlayer("play");
 		},
 		ended: function (event) {
 			window.location.href = "/";
 		},
-		supplied: "oga",
+		supplied: "{{ .Format }}",
 		wmode: "window",
 		useStateClassSkin: true,
 		autoBlur: false,